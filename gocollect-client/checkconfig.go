@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	getopt "github.com/ossobv/go-getopt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ossobv/gocollect/gocollect-client/config"
+	"github.com/ossobv/gocollect/gocollect-client/control"
+	"github.com/ossobv/gocollect/gocollect-client/runner"
+)
+
+// coreIDKeys are the values of the stock core.id collector. They can
+// be used as placeholders in the push_url, like the ones that the
+// runner adds itself.
+var coreIDKeys = []string{
+	"fqdn", "ip4", "regid", "machine-id", "system-manufacturer",
+	"system-product-name", "system-version", "system-serial-number",
+	"system-uuid",
+}
+
+// pushURLPlaceholders returns the {placeholders} that the runner fills
+// in in the push_url.
+func pushURLPlaceholders() map[string]bool {
+	ret := map[string]bool{
+		runner.PlaceholderCollector: true,
+		runner.PlaceholderVersion:   true,
+		runner.PlaceholderAPIKey:    true,
+	}
+	for _, key := range coreIDKeys {
+		ret[key] = true
+	}
+	return ret
+}
+
+// checkConfigAndExit reports everything that is wrong with the config
+// file, and exits non-zero if there are errors (warnings are fine).
+func checkConfigAndExit(options map[string]getopt.OptionValue) {
+	conf, e := parseConfig(options["config"].String, options)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%s: error: %s\n", options["config"].String, e)
+		os.Exit(1)
+	}
+
+	errorCount := 0
+	for _, problem := range checkConfig(options, conf) {
+		fmt.Println(problem)
+		if !problem.Warning {
+			errorCount++
+		}
+	}
+	if errorCount != 0 {
+		fmt.Printf("%s: %d error(s)\n", conf.Filename, errorCount)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: config OK\n", conf.Filename)
+	os.Exit(0)
+}
+
+// checkConfig returns everything that is wrong with the config.
+func checkConfig(
+	options map[string]getopt.OptionValue,
+	conf *config.Config) []config.Problem {
+
+	problems := conf.Check(configKeys)
+	_, runnerProblems := createCollectRunner(options, conf)
+	problems = append(problems, runnerProblems...)
+	cp := configParser{conf: conf}
+	cp.getDuration("shutdown_grace")
+	problems = append(problems, cp.problems...)
+	problems = append(problems, checkURL(conf, "register_url", nil)...)
+	problems = append(problems, checkURL(
+		conf, "push_url", pushURLPlaceholders())...)
+	return append(problems, checkCollectorsPaths(conf)...)
+}
+
+// doctorAndExit checks whether gocollect can do its work, and exits
+// non-zero if there are errors.
+func doctorAndExit(options map[string]getopt.OptionValue) {
+	if errorCount := doctor(os.Stdout, options); errorCount != 0 {
+		fmt.Printf("%d error(s)\n", errorCount)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// doctor checks the config, the collectors, the server and the daemon,
+// writes a report to w, and returns the number of errors.
+func doctor(
+	w io.Writer, options map[string]getopt.OptionValue) (errorCount int) {
+
+	report := func(level string, format string, args ...interface{}) {
+		if level == "error" {
+			errorCount++
+		}
+		fmt.Fprintf(w, "%-8s%s\n", level, fmt.Sprintf(format, args...))
+	}
+
+	// Without a usable config, there is nothing else to check.
+	conf, e := parseConfig(options["config"].String, options)
+	if e != nil {
+		report("error", "config: %s", e)
+		return errorCount
+	}
+	configErrors, configWarnings := 0, 0
+	for _, problem := range checkConfig(options, conf) {
+		if problem.Warning {
+			configWarnings++
+		} else {
+			configErrors++
+		}
+	}
+	if configErrors != 0 {
+		report("error", "config: %s: %d error(s); see 'gocollect check-config'",
+			conf.Filename, configErrors)
+		return errorCount
+	} else if configWarnings != 0 {
+		report("warning", "config: %s: %d warning(s); see "+
+			"'gocollect check-config'", conf.Filename, configWarnings)
+	} else {
+		report("ok", "config: %s", conf.Filename)
+	}
+	collectRunner, _ := createCollectRunner(options, conf)
+
+	if os.Getuid() != 0 {
+		report("warning", "user: not root; collectors may return too "+
+			"little info")
+	}
+
+	regid, e := ioutil.ReadFile(collectRunner.RegidFilename)
+	if os.IsNotExist(e) {
+		report("warning", "regid: not registered yet; see "+
+			"'gocollect register'")
+	} else if e != nil {
+		report("error", "regid: %s", e)
+	} else {
+		report("ok", "regid: %s", strings.TrimSpace(string(regid)))
+	}
+
+	// A requirement is met if all commands of one of its packages are
+	// found. (We cannot check packages without commands.)
+	enabled := 0
+	for _, info := range collectRunner.ListCollectors() {
+		if !info.Enabled {
+			continue
+		}
+		enabled++
+		for _, requirement := range info.Requires {
+			found := false
+			for _, pkg := range requirement {
+				found = true
+				for _, cmd := range pkg.Commands {
+					if _, e := exec.LookPath(cmd); e != nil {
+						found = false
+						break
+					}
+				}
+				if found {
+					break
+				}
+			}
+			if !found {
+				report("warning", "collector %s: missing %s",
+					info.Key, requirement)
+			}
+		}
+	}
+	report("ok", "collectors: %d enabled", enabled)
+
+	checked := make(map[string]bool)
+	for _, rawurl := range []string{
+		collectRunner.RegisterURL, collectRunner.PushURL} {
+
+		u, e := url.Parse(rawurl)
+		if e != nil || u.Host == "" {
+			continue // check-config reports these
+		}
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), u.Scheme)
+		}
+		if checked[address] {
+			continue
+		}
+		checked[address] = true
+		conn, e := net.DialTimeout("tcp", address, doctorTimeout)
+		if e != nil {
+			report("error", "server: %s", e)
+			continue
+		}
+		conn.Close()
+		report("ok", "server: %s is reachable", address)
+	}
+
+	cp := configParser{conf: conf}
+	path := cp.getString("control_socket")
+	if path == "" {
+		report("warning", "daemon: control_socket is disabled; "+
+			"cannot check the daemon")
+	} else if _, e := control.Send(
+		path, control.Request{Command: "status"}, doctorTimeout); e != nil {
+		report("warning", "daemon: not running (%s)", e)
+	} else {
+		report("ok", "daemon: running")
+	}
+
+	return errorCount
+}
+
+// printConfigAndExit shows the effective value of every config key,
+// and the file and line it came from.
+func printConfigAndExit(
+	options map[string]getopt.OptionValue, conf *config.Config) {
+
+	settings := conf.Effective(configKeys)
+	var e error
+	if options["json"].Bool {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		e = encoder.Encode(struct {
+			Config   string           `json:"config"`
+			Files    []string         `json:"files"`
+			Settings []config.Setting `json:"settings"`
+		}{conf.Filename, conf.Files, settings})
+	} else {
+		for _, filename := range conf.Files {
+			fmt.Printf("# read %s\n", filename)
+		}
+		e = config.WriteSettings(os.Stdout, settings)
+	}
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), e)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// checkURL checks that the URL in key is set, is a http(s) URL and uses
+// only the allowed placeholders.
+func checkURL(
+	conf *config.Config, key string,
+	placeholders map[string]bool) (problems []config.Problem) {
+
+	entries := conf.Lookup(key)
+	if len(entries) == 0 {
+		return []config.Problem{{
+			Pos: conf.Filename, Message: key + " is not set"}}
+	}
+	entry := entries[len(entries)-1]
+	fail := func(warning bool, format string, args ...interface{}) {
+		problems = append(problems, config.Problem{
+			Pos: entry.Pos(), Warning: warning,
+			Message: key + ": " + fmt.Sprintf(format, args...)})
+	}
+
+	// Replace the placeholders, so we can parse the rest.
+	var plain strings.Builder
+	used := make(map[string]bool)
+	rest := entry.Value
+	for {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			plain.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}') + start
+		if rest[start] == '}' || end < start ||
+			strings.IndexByte(rest[start+1:end], '{') >= 0 {
+			fail(false, "unbalanced braces")
+			return problems
+		}
+		name := rest[start+1 : end]
+		if !placeholders[name] {
+			if len(placeholders) == 0 {
+				fail(false, "placeholders are not supported here: {%s}", name)
+			} else {
+				// A custom core.id may provide more values.
+				fail(true, "unknown placeholder {%s}", name)
+			}
+		}
+		used[name] = true
+		plain.WriteString(rest[:start])
+		plain.WriteString("x")
+		rest = rest[end+1:]
+	}
+
+	parsed, e := url.Parse(plain.String())
+	if e != nil {
+		fail(false, "%s", e)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		fail(false, "expected a http or https URL")
+	} else if parsed.Host == "" {
+		fail(false, "missing host")
+	}
+	collector := runner.PlaceholderCollector
+	if placeholders[collector] && !used[collector] {
+		fail(true, "no {_collector}; all collectors push to the same URL")
+	}
+	return problems
+}
+
+// checkCollectorsPaths checks that the collectors paths are
+// directories. Missing paths are fine, as long as one of them exists.
+func checkCollectorsPaths(conf *config.Config) (problems []config.Problem) {
+	found := false
+	for _, entry := range conf.Lookup("collectors_path") {
+		info, e := os.Stat(entry.Value)
+		switch {
+		case os.IsNotExist(e):
+			problems = append(problems, config.Problem{
+				Pos: entry.Pos(), Warning: true,
+				Message: "collectors_path " + entry.Value +
+					" does not exist"})
+		case e != nil:
+			problems = append(problems, config.Problem{
+				Pos: entry.Pos(), Message: e.Error()})
+		case !info.IsDir():
+			problems = append(problems, config.Problem{
+				Pos: entry.Pos(), Message: "collectors_path " +
+					entry.Value + " is not a directory"})
+		default:
+			found = true
+		}
+	}
+	if !found {
+		problems = append(problems, config.Problem{
+			Pos: conf.Filename, Message: "no usable collectors_path"})
+	}
+	return problems
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	getopt "github.com/ossobv/go-getopt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ossobv/gocollect/gocollect-client/control"
+)
+
+// writeDoctorConfig writes a config file with a single collector,
+// app.x, that requires a command that does not exist.
+func writeDoctorConfig(
+	t *testing.T, serverURL string, extra string) (
+	options map[string]getopt.OptionValue, socket string) {
+
+	dir, e := ioutil.TempDir("", "gocollect-doctor-")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	collectorsPath := filepath.Join(dir, "collectors")
+	os.Mkdir(collectorsPath, 0755)
+	ioutil.WriteFile(filepath.Join(collectorsPath, "app.x"), []byte(
+		"#!/bin/sh\n# REQUIRES: nopkg(gocollect-no-such-command)\n"+
+			"echo '{}'\n"), 0755)
+
+	socket = filepath.Join(dir, "control.sock")
+	filename := filepath.Join(dir, "gocollect.conf")
+	ioutil.WriteFile(filename, []byte(fmt.Sprintf(
+		"register_url = %s/register/\n"+
+			"push_url = %s/push/{regid}/{_collector}/\n"+
+			"collectors_path = %s\n"+
+			"control_socket = %s\n%s",
+		serverURL, serverURL, collectorsPath, socket, extra)), 0644)
+	return map[string]getopt.OptionValue{
+		"config": {String: filename}}, socket
+}
+
+func TestDoctor(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	options, socket := writeDoctorConfig(t, server.URL, "")
+	daemon, e := control.Listen(
+		socket, func(req control.Request) control.Response {
+			return control.Response{OK: true}
+		})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer daemon.Close()
+
+	var buf bytes.Buffer
+	if errorCount := doctor(&buf, options); errorCount != 0 {
+		t.Errorf("got %d errors, expected none:\n%s", errorCount, buf.String())
+	}
+	u, _ := url.Parse(server.URL)
+	for _, expected := range []string{
+		"ok      config: ",
+		"warning collector app.x: missing nopkg(gocollect-no-such-command)",
+		"ok      server: " + u.Host + " is reachable",
+		"ok      daemon: running",
+	} {
+		if !strings.Contains(buf.String(), "\n"+expected) &&
+			!strings.HasPrefix(buf.String(), expected) {
+			t.Errorf("missing %q in:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestDoctor_Unreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	options, _ := writeDoctorConfig(t, server.URL, "")
+
+	var buf bytes.Buffer
+	if errorCount := doctor(&buf, options); errorCount != 1 {
+		t.Errorf("got %d errors, expected 1:\n%s", errorCount, buf.String())
+	}
+	for _, expected := range []string{
+		"error   server: ", "warning daemon: not running",
+	} {
+		if !strings.Contains(buf.String(), "\n"+expected) {
+			t.Errorf("missing %q in:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestDoctor_BadConfig(t *testing.T) {
+	options, _ := writeDoctorConfig(
+		t, "http://127.0.0.1:1", "run_interval = often\n")
+
+	var buf bytes.Buffer
+	if errorCount := doctor(&buf, options); errorCount != 1 {
+		t.Errorf("got %d errors, expected 1:\n%s", errorCount, buf.String())
+	}
+	if !strings.HasPrefix(buf.String(), "error   config: ") ||
+		!strings.Contains(buf.String(), ": 1 error(s);") ||
+		strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("expected only the config error, got:\n%s", buf.String())
+	}
+}
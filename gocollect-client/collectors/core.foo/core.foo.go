@@ -2,10 +2,13 @@
 package builtincollector
 
 import (
+	"context"
+
 	"github.com/ossobv/gocollect/gocollect-client/data"
 )
 
-func runCoreMeta(key string, runargs string) data.Collected {
+func runCoreMeta(ctx context.Context, key string, runargs string,
+	settings data.Settings) data.Collected {
 	ret, _ := data.NewCollected([]byte("{\"foo\":\"bar\"}"))
 	return ret
 }
@@ -2,8 +2,10 @@
 package builtincollector
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	golog "log"
 	"path/filepath"
 	"strings"
 
@@ -23,14 +25,16 @@ import (
 const coreMetaJsPath = "/var/lib/gocollect/core.meta.js"
 const coreMetaStarYamlPath = "./gocollect/core.meta" // relative to conf
 
-func collect(key string, runargs string) data.Collected {
+func collect(ctx context.Context, key string, runargs string,
+	settings data.Settings) data.Collected {
 	// If it exists, read JS file from /var/lib/gollect; old style.
 	if collected, err := collectVarLibGocollectCoreMetaJs(); err == nil {
 		return collected
 	}
 
 	// If it doesn't, read the combined YAML files from /etc; new style.
-	if collected, err := collectEtcGocollectCoreMetaStarYaml(); err == nil {
+	if collected, err := collectEtcGocollectCoreMetaStarYaml(
+		log.FromContext(ctx)); err == nil {
 		return collected
 	}
 
@@ -46,7 +50,8 @@ func collectVarLibGocollectCoreMetaJs() (data.Collected, error) {
 	return data.NewCollected(collected)
 }
 
-func collectEtcGocollectCoreMetaStarYaml() (data.Collected, error) {
+func collectEtcGocollectCoreMetaStarYaml(
+	logger *golog.Logger) (data.Collected, error) {
 	// Get config path.
 	yamlPath := coreMetaStarYamlPath
 	runner := runnerinst.GetRunner()
@@ -55,7 +60,7 @@ func collectEtcGocollectCoreMetaStarYaml() (data.Collected, error) {
 	}
 
 	// If this fails here, ignore it silently.
-	yamlData, err := getYamlData(yamlPath)
+	yamlData, err := getYamlData(logger, yamlPath)
 	if err != nil {
 		return nil, err
 	}
@@ -67,7 +72,7 @@ func collectEtcGocollectCoreMetaStarYaml() (data.Collected, error) {
 		var yamlObj interface{}
 		err := yaml.Unmarshal(yamlBytes, &yamlObj)
 		if err != nil {
-			log.Log.Printf("collector[core.meta]: yaml: %s", err)
+			logger.Printf("collector[core.meta]: yaml: %s", err)
 		} else {
 			outDict[key] = yamlObj
 		}
@@ -75,14 +80,15 @@ func collectEtcGocollectCoreMetaStarYaml() (data.Collected, error) {
 
 	jsonBytes, err := json.Marshal(&outDict)
 	if err != nil {
-		log.Log.Printf("collector[core.meta]: json: %s", err)
+		logger.Printf("collector[core.meta]: json: %s", err)
 		return nil, err
 	}
 
 	return data.NewCollected(jsonBytes)
 }
 
-func getYamlData(filespath string) (map[string]([]byte), error) {
+func getYamlData(
+	logger *golog.Logger, filespath string) (map[string]([]byte), error) {
 	ret := make(map[string]([]byte))
 
 	// ReadDir reads the directory named by dirname and returns a list
@@ -100,7 +106,7 @@ func getYamlData(filespath string) (map[string]([]byte), error) {
 				fullpath := filepath.Join(filespath, name)
 				data, err := ioutil.ReadFile(fullpath)
 				if err != nil {
-					log.Log.Printf("collector[core.meta]: %s: %s", fullpath,
+					logger.Printf("collector[core.meta]: %s: %s", fullpath,
 						err)
 				} else {
 					nameWithoutYaml := name[0 : len(name)-5] // ".yaml"
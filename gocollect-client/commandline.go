@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	getopt "github.com/ossobv/go-getopt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Options that more than one command takes.
+var (
+	configOption = getopt.Option{
+		OptionDefinition: "config|c",
+		Description:      "config file",
+		Flags:            (getopt.Optional | getopt.ExampleIsDefault),
+		DefaultValue:     defaultConfigFile}
+	strictIncludesOption = getopt.Option{
+		OptionDefinition: "strict-includes",
+		Description:      "fail if an included config file is missing",
+		Flags:            getopt.Flag,
+		DefaultValue:     false}
+	withoutRootOption = getopt.Option{
+		OptionDefinition: "without-root",
+		Description:      "allow run as non-privileged user",
+		Flags:            getopt.Flag,
+		DefaultValue:     false}
+	jsonOption = getopt.Option{
+		OptionDefinition: "json",
+		Description:      "print JSON",
+		Flags:            getopt.Flag,
+		DefaultValue:     false}
+)
+
+// command is a gocollect subcommand, with its own options.
+type command struct {
+	name        string
+	args        string // the arguments, for the usage
+	description string
+	minArgs     int
+	maxArgs     int // or -1 for no limit
+	definitions getopt.Definitions
+}
+
+// commands are the gocollect subcommands. The old options, like -s and
+// -k KEY, still work; see legacyCommand.
+var commands = []command{
+	{name: "daemon",
+		description: "run the collectors periodically (the default)",
+		definitions: getopt.Definitions{
+			configOption, strictIncludesOption, withoutRootOption}},
+	{name: "run",
+		description: "run all collectors once",
+		definitions: getopt.Definitions{
+			configOption, strictIncludesOption, withoutRootOption,
+			{OptionDefinition: "delegate",
+				Description:  "ask the running gocollect to do the run",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "dry-run",
+				Description:  "show the data instead of pushing it",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "output-dir",
+				Description:  "with --dry-run: write the data to files in this dir",
+				Flags:        getopt.Optional,
+				DefaultValue: ""}}},
+	{name: "collect", args: "KEY...", minArgs: 1, maxArgs: -1,
+		description: "print the data of the collectors, without pushing",
+		definitions: getopt.Definitions{
+			configOption, strictIncludesOption, withoutRootOption}},
+	{name: "list",
+		description: "list the collectors and where they come from",
+		definitions: getopt.Definitions{
+			configOption, strictIncludesOption, jsonOption}},
+	{name: "register",
+		description: "register this host if needed, print the regid",
+		definitions: getopt.Definitions{
+			configOption, strictIncludesOption, withoutRootOption}},
+	{name: "status",
+		description: "show the results of the last run",
+		definitions: getopt.Definitions{configOption, strictIncludesOption}},
+	{name: "check-config",
+		description: "check the config file",
+		definitions: getopt.Definitions{
+			configOption, strictIncludesOption,
+			{OptionDefinition: "print",
+				Description:  "print the effective config instead",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			jsonOption}},
+	{name: "doctor",
+		description: "check config, collectors and connections",
+		definitions: getopt.Definitions{configOption, strictIncludesOption}},
+	{name: "ctl", args: "COMMAND [ARG...]", minArgs: 1, maxArgs: -1,
+		description: "control the running daemon",
+		definitions: getopt.Definitions{configOption, strictIncludesOption}},
+	{name: "export", args: "[FILE]", maxArgs: 1,
+		description: "write the data to a bundle, for import-push",
+		definitions: getopt.Definitions{
+			configOption, strictIncludesOption, withoutRootOption}},
+	{name: "import-push", args: "BUNDLE", minArgs: 1, maxArgs: 1,
+		description: "push a bundle made by export on another host",
+		definitions: getopt.Definitions{configOption, strictIncludesOption}},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func (cmd *command) getOptionDefinition() getopt.Options {
+	usage := strings.TrimSpace("gocollect " + cmd.name + " [OPTIONS] " + cmd.args)
+	return getopt.Options{
+		Description: (usage + "\n\n" + strings.ToUpper(cmd.description[:1]) +
+			cmd.description[1:] + "."),
+		Definitions: cmd.definitions,
+	}
+}
+
+// checkArguments checks the number of command arguments.
+func (cmd *command) checkArguments(arguments []string) string {
+	if len(arguments) < cmd.minArgs {
+		return "missing arguments: " + cmd.args
+	} else if cmd.maxArgs >= 0 && len(arguments) > cmd.maxArgs {
+		return "too many arguments"
+	}
+	return ""
+}
+
+func getOptionDefinition() getopt.Options {
+	commandList := ""
+	for _, cmd := range commands {
+		commandList += fmt.Sprintf(
+			"\n  %-20s %s", strings.TrimSpace(cmd.name+" "+cmd.args),
+			cmd.description)
+	}
+	return getopt.Options{
+		// ..4...8......16......24......32......40......48......56......64
+		Description: ("GoCollect collects data through a series of scripts " +
+			"and publishes it to\na central server.\n\n" +
+			"Usage: gocollect [COMMAND] [OPTIONS]\n\nCommands:" +
+			commandList + "\n\n" +
+			"See 'gocollect COMMAND --help' for the options of a command.\n" +
+			"The options below are the old way to select a command."),
+		Definitions: getopt.Definitions{
+			configOption,
+			{OptionDefinition: "one-shot|s",
+				Description:  "run once and exit (run)",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "delegate",
+				Description:  "with -s: ask the running gocollect to do the run",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "test-key|k",
+				Description:  "print single collector output on stdout (collect)",
+				Flags:        getopt.Optional,
+				DefaultValue: ""},
+			{OptionDefinition: "dry-run",
+				Description:  "run all collectors, but show the data instead of pushing",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "output-dir",
+				Description:  "with --dry-run: write the data to files in this dir",
+				Flags:        getopt.Optional,
+				DefaultValue: ""},
+			strictIncludesOption,
+			{OptionDefinition: "check-config",
+				Description:  "check the config file and exit (check-config)",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "print-config",
+				Description:  "print the effective config and exit",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "list",
+				Description:  "list the collectors and exit (list)",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "json",
+				Description:  "with --print-config or --list: print JSON",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			{OptionDefinition: "status",
+				Description:  "show the results of the last run (status)",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+			withoutRootOption,
+			{OptionDefinition: "version|V",
+				Description:  "print version",
+				Flags:        getopt.Flag,
+				DefaultValue: false},
+		},
+	}
+}
+
+// parseCommandLineOrExit returns the command, with its options and
+// arguments. Without a command, the old options select one.
+func parseCommandLineOrExit() (
+	name string, options map[string]getopt.OptionValue, arguments []string) {
+
+	args := os.Args[1:]
+	if i := findCommandArg(args); i >= 0 {
+		cmd := findCommand(args[i])
+		rest := append(append([]string{}, args[:i]...), args[i+1:]...)
+		options, arguments = parseCommandArgsOrExit(cmd, rest)
+		return cmd.name, options, arguments
+	}
+	options, _ = parseArgsOrExit()
+	name, arguments = legacyCommand(options)
+	return name, options, arguments
+}
+
+// findCommandArg returns the index of the command in args, or -1. The
+// options before it are skipped, with their values: "-c FILE run".
+func findCommandArg(args []string) int {
+	takesValue := make(map[string]bool)
+	for _, definition := range getOptionDefinition().Definitions {
+		if definition.Flags&getopt.Flag == 0 {
+			for _, opt := range strings.Split(definition.OptionDefinition, "|") {
+				takesValue[opt] = true
+			}
+		}
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return -1
+		case strings.HasPrefix(arg, "--"):
+			if takesValue[arg[2:]] {
+				i++ // not "--config=FILE"
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// The value follows the letter, or is the next arg if the
+			// letter is last: "-cFILE", "-sc FILE".
+			for j := 1; j < len(arg); j++ {
+				if takesValue[arg[j:j+1]] {
+					if j == len(arg)-1 {
+						i++
+					}
+					break
+				}
+			}
+		default:
+			if findCommand(arg) == nil {
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// parseCommandArgsOrExit parses the options and arguments of the
+// command.
+func parseCommandArgsOrExit(cmd *command, args []string) (
+	options map[string]getopt.OptionValue, arguments []string) {
+
+	// The option parser takes os.Args, and uses its program name in
+	// the usage. Put the command there while we're parsing, so it shows
+	// up in the usage and the error messages.
+	progName := filepath.Base(os.Args[0]) + " " + cmd.name
+	defer func(saved []string) { os.Args = saved }(os.Args)
+	os.Args = append([]string{progName}, args...)
+	optionDefinition := cmd.getOptionDefinition()
+	options, arguments, passThrough, e := optionDefinition.ParseCommandLine()
+
+	// Check and print help before checking option syntax.
+	if _, ok := options["help"]; ok {
+		fmt.Print(optionDefinition.Help())
+		os.Exit(0)
+	} else if e != nil {
+		printErrorAndExit(progName, e.Error(), optionDefinition)
+	} else if len(passThrough) != 0 {
+		errstr := fmt.Sprintf("excess args after -- %#v", passThrough)
+		printErrorAndExit(progName, errstr, optionDefinition)
+	} else if errstr := cmd.checkArguments(arguments); errstr != "" {
+		printErrorAndExit(progName, errstr, optionDefinition)
+	}
+	return options, arguments
+}
+
+func parseArgsOrExit() (
+	options map[string]getopt.OptionValue, arguments []string) {
+
+	progName := filepath.Base(os.Args[0])
+	optionDefinition := getOptionDefinition()
+	options, arguments, passThrough, e := optionDefinition.ParseCommandLine()
+
+	// Check and print help before checking option syntax.
+	if _, ok := options["help"]; ok {
+		fmt.Print(optionDefinition.Help())
+		os.Exit(0)
+	} else if e != nil {
+		printErrorAndExit(progName, e.Error(), optionDefinition)
+	} else if len(arguments) != 0 {
+		errstr := fmt.Sprintf("unknown command %q", arguments[0])
+		printErrorAndExit(progName, errstr, optionDefinition)
+	} else if val, ok := options["version"]; ok && val.Bool {
+		printVersionAndExit()
+	} else if len(passThrough) != 0 {
+		errstr := fmt.Sprintf("excess args after -- %#v", passThrough)
+		printErrorAndExit(progName, errstr, optionDefinition)
+	}
+
+	// debugPrintOptions(options)
+	return options, arguments
+}
+
+// legacyCommand returns the command for the old options: -s is run,
+// -k KEY is collect KEY, and no options at all is daemon.
+func legacyCommand(options map[string]getopt.OptionValue) (
+	name string, arguments []string) {
+
+	switch {
+	case options["check-config"].Bool:
+		return "check-config", nil
+	case options["print-config"].Bool:
+		options["print"] = getopt.OptionValue{Bool: true}
+		return "check-config", nil
+	case options["list"].Bool:
+		return "list", nil
+	case options["status"].Bool:
+		return "status", nil
+	}
+	if testKey, ok := options["test-key"]; ok {
+		return "collect", []string{testKey.String}
+	}
+	if options["one-shot"].Bool || isDryRun(options) {
+		return "run", nil
+	}
+	return "daemon", nil
+}
+
+func debugPrintOptions(options map[string]getopt.OptionValue) {
+	for key, value := range options {
+		fmt.Printf("%s = %v\n", key, value)
+	}
+}
+
+// isDryRun returns true for --dry-run, which --output-dir implies.
+func isDryRun(options map[string]getopt.OptionValue) bool {
+	_, ok := options["output-dir"]
+	return ok || options["dry-run"].Bool
+}
+
+func checkOptionsOrExit(name string, options map[string]getopt.OptionValue) {
+	// Check that user is root.
+	if os.Getuid() != 0 && !options["without-root"].Bool {
+		if name == "collect" || name == "export" || isDryRun(options) {
+			fmt.Fprintf(
+				os.Stderr,
+				("%s: Beware, running the collector as non-superuser may " +
+					"yield incomplete data.\n"),
+				filepath.Base(os.Args[0]))
+			// don't exit
+		} else {
+			fmt.Fprintf(
+				os.Stderr,
+				("%s: Running gocollect as non-privileged user may " +
+					"cause several\n" +
+					"collectors to return too little info. Pass " +
+					"--without-root to bypass this check.\n"),
+				filepath.Base(os.Args[0]))
+			os.Exit(1)
+		}
+	}
+
+	// The old options can still be mixed: only allow --delegate and
+	// --dry-run with run (-s).
+	if name != "run" && (options["delegate"].Bool || isDryRun(options)) {
+		fmt.Fprintf(
+			os.Stderr,
+			"%s: --delegate and --dry-run only work with run (-s).\n",
+			filepath.Base(os.Args[0]))
+		os.Exit(1)
+	}
+	if options["delegate"].Bool && isDryRun(options) {
+		fmt.Fprintf(
+			os.Stderr, "%s: --dry-run does not work with --delegate.\n",
+			filepath.Base(os.Args[0]))
+		os.Exit(1)
+	}
+}
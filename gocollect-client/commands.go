@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	getopt "github.com/ossobv/go-getopt"
+	"io"
+	"io/ioutil"
+	golog "log"
+	"os"
+	"path/filepath"
+
+	"github.com/ossobv/gocollect/gocollect-client/config"
+	"github.com/ossobv/gocollect/gocollect-client/control"
+	"github.com/ossobv/gocollect/gocollect-client/data"
+	"github.com/ossobv/gocollect/gocollect-client/log"
+	"github.com/ossobv/gocollect/gocollect-client/runner"
+)
+
+// controlClientAndExit sends a command to the running daemon and
+// prints the response.
+func controlClientAndExit(conf *config.Config, args []string) {
+	cp := configParser{conf: conf}
+	path := cp.getString("control_socket")
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "%s: control_socket is disabled\n",
+			filepath.Base(os.Args[0]))
+		os.Exit(1)
+	}
+
+	resp, e := control.Send(
+		path, control.Request{Command: args[0], Args: args[1:]},
+		controlTimeout)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), e)
+		os.Exit(1)
+	}
+	if resp.Message != "" {
+		fmt.Println(resp.Message)
+	}
+	if resp.Data != nil {
+		encoded, _ := json.MarshalIndent(resp.Data, "", "  ")
+		fmt.Println(string(encoded))
+	}
+	if !resp.OK {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// listCollectorsAndExit shows all collectors, where they come from and
+// whether they are enabled.
+func listCollectorsAndExit(
+	options map[string]getopt.OptionValue, conf *config.Config) {
+
+	collectRunner := createCollectRunnerOrExit(options, conf)
+	list := collectRunner.ListCollectors()
+	var e error
+	if options["json"].Bool {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		e = encoder.Encode(list)
+	} else {
+		e = runner.WriteCollectors(os.Stdout, list)
+	}
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), e)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// collectAndExit runs the collectors and prints their data. All stderr
+// output is shown; the collector author will want to see that.
+func collectAndExit(collectRunner *runner.Runner, keys []string) {
+	collectRunner.StderrLogLimit = data.LogLimit{}
+	failed := false
+	for _, key := range keys {
+		result := collectRunner.Get(key)
+		if result == "" {
+			failed = true
+			continue
+		}
+		if len(keys) > 1 {
+			fmt.Printf("# %s\n", key)
+		}
+		fmt.Print(result)
+	}
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// register registers the host, unless it was registered
+// already, and prints the regid.
+func register(collectRunner *runner.Runner) (exitCode int) {
+	regid, e := collectRunner.Register()
+	if e != nil {
+		log.Log.Printf("register: %s", e)
+		return 1
+	}
+	fmt.Println(regid)
+	return 0
+}
+
+// dryRunAndExit runs all collectors and writes their data and push URL
+// to stdout, or to KEY.json and KEY.url files in outputDir.
+func dryRunAndExit(collectRunner *runner.Runner, outputDir string) {
+	write := func(collectorKey string, pushURL string, data []byte) error {
+		_, e := fmt.Printf("# %s\n# POST %s\n%s", collectorKey, pushURL, data)
+		return e
+	}
+	if outputDir != "" {
+		if e := os.MkdirAll(outputDir, 0755); e != nil {
+			log.Log.Fatalf("dry run: %s", e)
+		}
+		write = func(collectorKey string, pushURL string, data []byte) error {
+			path := filepath.Join(outputDir, collectorKey)
+			e := ioutil.WriteFile(path+".json", data, 0644)
+			if e == nil {
+				e = ioutil.WriteFile(path+".url", []byte(pushURL+"\n"), 0644)
+			}
+			return e
+		}
+	}
+	if e := collectRunner.DryRun(write); e != nil {
+		log.Log.Fatalf("dry run: %s", e)
+	}
+	os.Exit(0)
+}
+
+// exportAndExit runs all collectors and writes their data to a bundle
+// file (or stdout), for "gocollect import-push" on a host that can reach
+// the server.
+func exportAndExit(collectRunner *runner.Runner, filename string) {
+	if filename == "" {
+		if e := collectRunner.Export(os.Stdout); e != nil {
+			log.Log.Fatalf("export: %s", e)
+		}
+		os.Exit(0)
+	}
+
+	// The core.id data may hold secrets (the api key), so keep it private.
+	file, e := os.OpenFile(
+		filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if e == nil {
+		e = collectRunner.Export(file)
+		if e2 := file.Close(); e == nil {
+			e = e2
+		}
+		if e != nil {
+			os.Remove(filename)
+		}
+	}
+	if e != nil {
+		log.Log.Fatalf("export: %s", e)
+	}
+	log.Log.Printf("export: wrote %s", filename)
+	os.Exit(0)
+}
+
+// importPushAndExit pushes a bundle made by "gocollect export" on
+// another host, as if that host pushed it.
+func importPushAndExit(
+	options map[string]getopt.OptionValue, conf *config.Config,
+	filename string) {
+
+	collectRunner := createCollectRunnerOrExit(options, conf)
+	// Log to stderr, but keep stdin: the bundle may come from there.
+	log.Log = golog.New(os.Stderr, "", golog.LstdFlags)
+
+	var bundle io.Reader = os.Stdin
+	if filename != "-" {
+		file, e := os.Open(filename)
+		if e != nil {
+			log.Log.Fatalf("import-push: %s", e)
+		}
+		defer file.Close()
+		bundle = file
+	}
+	regid, e := collectRunner.ImportPush(bundle)
+	if regid != "" {
+		fmt.Printf(
+			"Registered the host as %s. Store that in %s on the host,\n"+
+				"or it will register again.\n",
+			regid, collectRunner.RegidFilename)
+	}
+	if e != nil {
+		log.Log.Fatalf("import-push: %s", e)
+	}
+	log.Log.Printf("import-push: done")
+	os.Exit(0)
+}
+
+// printStatusAndExit shows the results of the last run, as stored in
+// the state file.
+func printStatusAndExit(
+	options map[string]getopt.OptionValue, conf *config.Config) {
+
+	collectRunner := createCollectRunnerOrExit(options, conf)
+	if e := collectRunner.WriteStatus(os.Stdout); e != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), e)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,112 @@
+// Package config (gocollect) reads the GoCollect configuration file.
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Key describes a known config key.
+type Key struct {
+	// Multi keys may occur more than once and all values are used.
+	// For the other keys, the last value wins.
+	Multi bool
+	// Default is the value used when the key is not set.
+	Default string
+}
+
+// Problem is an error (or warning) in the config.
+type Problem struct {
+	// Pos is "file:line", or just the file name.
+	Pos     string
+	Warning bool
+	Message string
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Pos, level, p.Message)
+}
+
+// Check returns the parse problems, plus the unknown keys and the
+// single-value keys that are set more than once.
+func (c *Config) Check(known map[string]Key) []Problem {
+	problems := append([]Problem{}, c.Problems...)
+
+	last := make(map[string]Entry)
+	for _, entry := range c.Entries {
+		if _, ok := known[entry.Key]; !ok {
+			message := "unknown key " + entry.Key
+			if suggestion := suggestKey(entry.Key, known); suggestion != "" {
+				message += " (did you mean " + suggestion + "?)"
+			}
+			problems = append(problems, Problem{
+				Pos: entry.Pos(), Message: message})
+		}
+		last[entry.Key] = entry
+	}
+
+	for _, entry := range c.Entries {
+		if key, ok := known[entry.Key]; ok && !key.Multi {
+			if winner := last[entry.Key]; winner != entry {
+				problems = append(problems, Problem{
+					Pos: entry.Pos(), Warning: true,
+					Message: fmt.Sprintf("%s is overridden at %s",
+						entry.Key, winner.Pos())})
+			}
+		}
+	}
+	return problems
+}
+
+// suggestKey returns the known key closest to key, if it is close
+// enough to be a typo.
+func suggestKey(key string, known map[string]Key) string {
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if distance := editDistance(key, name); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
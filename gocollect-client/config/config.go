@@ -0,0 +1,245 @@
+// Package config (gocollect) reads the GoCollect configuration file.
+//
+// The file consists of "key = value" lines. Empty lines and lines
+// starting with a # are ignored. Keys may occur more than once; for
+// keys where only a single value makes sense, the *last* value wins.
+//
+// The special "include" key reads other files in place. The value is a
+// file, a directory (all *.conf files in it) or a glob, relative to
+// the including file. Matches are read in lexical order.
+//
+// Values may refer to environment variables as ${VAR} or
+// ${VAR:-default}. The GOCOLLECT_<KEY> environment variables override
+// the single-value keys.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Entry is a single "key = value" line.
+type Entry struct {
+	Key   string
+	Value string
+	File  string // or "$GOCOLLECT_<KEY>" for environment overrides
+	Line  int    // 1-based; 0 for environment overrides
+}
+
+// Pos returns the position of the entry as "file:line".
+func (e Entry) Pos() string {
+	if e.Line == 0 {
+		return e.File
+	}
+	return fmt.Sprintf("%s:%d", e.File, e.Line)
+}
+
+// Config holds the entries of the config file and its includes.
+type Config struct {
+	// Filename is the absolute path of the main config file.
+	Filename string
+	// Files holds all files that were read, in order.
+	Files []string
+	// Entries holds all entries, in order.
+	Entries []Entry
+	// Problems with lines and includes that were skipped.
+	Problems []Problem
+}
+
+// Options change how the config is parsed.
+type Options struct {
+	// StrictIncludes makes an include of a file that cannot be read an
+	// error. (A glob that matches nothing is never an error.)
+	StrictIncludes bool
+	// Known keys. The single-value ones can be overridden through the
+	// environment.
+	Known map[string]Key
+	// LookupEnv looks up environment variables; os.LookupEnv if nil.
+	LookupEnv func(name string) (string, bool)
+}
+
+type parser struct {
+	conf  *Config
+	opts  Options
+	stack []string // files being read, for cycle detection
+}
+
+// Parse reads the config file and its includes.
+func Parse(filename string, opts Options) (*Config, error) {
+	absname, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{conf: &Config{Filename: absname}, opts: opts}
+	if err = p.parseFile(absname); err != nil {
+		return nil, err
+	}
+	p.applyEnv()
+	return p.conf, nil
+}
+
+// Dir returns the directory of the main config file.
+func (c *Config) Dir() string {
+	return filepath.Dir(c.Filename)
+}
+
+// Lookup returns the entries with this key, in order.
+func (c *Config) Lookup(key string) (ret []Entry) {
+	for _, entry := range c.Entries {
+		if entry.Key == key {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// Values returns the values of this key, in order.
+func (c *Config) Values(key string) (ret []string) {
+	for _, entry := range c.Lookup(key) {
+		ret = append(ret, entry.Value)
+	}
+	return ret
+}
+
+// Get returns the last value of this key.
+func (c *Config) Get(key string) (value string, ok bool) {
+	for i := len(c.Entries) - 1; i >= 0; i-- {
+		if c.Entries[i].Key == key {
+			return c.Entries[i].Value, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseFile(filename string) error {
+	// Detect include cycles on the real path.
+	realname, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		realname = filename
+	}
+	for i, parent := range p.stack {
+		if parent == realname {
+			cycle := append(append([]string{}, p.stack[i:]...), realname)
+			return errors.New(
+				"include cycle: " + strings.Join(cycle, " -> "))
+		}
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	p.stack = append(p.stack, realname)
+	defer func() { p.stack = p.stack[:len(p.stack)-1] }()
+	p.conf.Files = append(p.conf.Files, filename)
+
+	for i, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		args := bytes.SplitN(line, []byte{'='}, 2)
+		if len(args) != 2 {
+			p.conf.Problems = append(p.conf.Problems, Problem{
+				Pos:     fmt.Sprintf("%s:%d", filename, i+1),
+				Message: "missing equals sign"})
+			continue
+		}
+
+		entry := Entry{
+			Key:   string(bytes.TrimSpace(args[0])),
+			Value: string(bytes.TrimSpace(args[1])),
+			File:  filename,
+			Line:  i + 1,
+		}
+		entry.Value = p.expand(entry)
+		if entry.Key == "include" {
+			if err = p.include(entry); err != nil {
+				return err
+			}
+		} else {
+			p.conf.Entries = append(p.conf.Entries, entry)
+		}
+	}
+	return nil
+}
+
+// include reads the files matching the include entry.
+func (p *parser) include(entry Entry) error {
+	pattern := entry.Value
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(entry.File), pattern)
+	}
+
+	var files []string
+	if strings.ContainsAny(pattern, "*?[") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include %s: %s", entry.Pos(), pattern, err)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			files = append(files, p.expandDir(match)...)
+		}
+	} else if _, err := os.Stat(pattern); err != nil {
+		return p.includeFailed(entry, err)
+	} else {
+		files = p.expandDir(pattern)
+	}
+
+	for _, filename := range files {
+		if err := p.parseFile(filename); err != nil {
+			if _, ok := err.(*os.PathError); ok {
+				err = p.includeFailed(entry, err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandDir returns the *.conf files in path if it is a directory, or
+// path itself otherwise.
+func (p *parser) expandDir(path string) []string {
+	fileinfo, err := os.Stat(path)
+	if err != nil || !fileinfo.IsDir() {
+		return []string{path}
+	}
+
+	var files []string
+	filelist, err := ioutil.ReadDir(path) // sorted by name
+	if err != nil {
+		return []string{path} // let parseFile report it
+	}
+	for _, fileinfo := range filelist {
+		name := fileinfo.Name()
+		if !fileinfo.IsDir() && !strings.HasPrefix(name, ".") &&
+			strings.HasSuffix(name, ".conf") {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	return files
+}
+
+// includeFailed returns an error for an include that could not be read
+// if includes are strict. Otherwise the include is skipped: missing
+// files silently, other errors with a warning.
+func (p *parser) includeFailed(entry Entry, err error) error {
+	if p.opts.StrictIncludes {
+		return fmt.Errorf("%s: include: %s", entry.Pos(), err)
+	}
+	if !os.IsNotExist(err) {
+		p.conf.Problems = append(p.conf.Problems, Problem{
+			Pos: entry.Pos(), Warning: true,
+			Message: "include skipped: " + err.Error()})
+	}
+	return nil
+}
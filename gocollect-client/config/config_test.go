@@ -0,0 +1,215 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParse_Includes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"gocollect.conf": ("# comment\n" +
+			"push_url = http://a/\n" +
+			"include = gocollect.conf.d\n" +
+			"include = extra/*.local\n" +
+			"include = /nonexistent/gocollect.conf\n" +
+			"collectors_path = /c\n"),
+		"gocollect.conf.d/20-b.conf":   "collectors_path = /b\n",
+		"gocollect.conf.d/10-a.conf":   "push_url = http://b/\n",
+		"gocollect.conf.d/30.disabled": "push_url = http://x/\n",
+		"extra/z.local":                "collectors_path = /z\n",
+	})
+	defer os.RemoveAll(dir)
+
+	conf, err := Parse(filepath.Join(dir, "gocollect.conf"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := conf.Get("push_url"); value != "http://b/" {
+		t.Errorf("push_url: got %s", value)
+	}
+	paths := strings.Join(conf.Values("collectors_path"), ",")
+	if paths != "/b,/z,/c" {
+		t.Errorf("collectors_path: got %s", paths)
+	}
+	entry := conf.Lookup("push_url")[1]
+	if entry.Pos() != filepath.Join(dir, "gocollect.conf.d/10-a.conf")+":1" {
+		t.Errorf("pos: got %s", entry.Pos())
+	}
+
+	_, err = Parse(
+		filepath.Join(dir, "gocollect.conf"), Options{StrictIncludes: true})
+	if err == nil || !strings.Contains(err.Error(), "gocollect.conf:5:") {
+		t.Errorf("strict: got %v", err)
+	}
+}
+
+func TestParse_Cycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.conf": "include = b.conf\n",
+		"b.conf": "include = a.conf\n",
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := Parse(filepath.Join(dir, "a.conf"), Options{})
+	if err == nil || !strings.HasPrefix(err.Error(), "include cycle: ") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"gocollect.conf": ("push_url = http://a/\n" +
+			"push_ur1 = http://b/\n" +
+			"collectors_path = /a\n" +
+			"collectors_path = /b\n" +
+			"push_url = http://c/\n" +
+			"oops\n"),
+	})
+	defer os.RemoveAll(dir)
+
+	conf, err := Parse(filepath.Join(dir, "gocollect.conf"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := map[string]Key{
+		"push_url":        {},
+		"collectors_path": {Multi: true},
+	}
+	var got []string
+	for _, problem := range conf.Check(known) {
+		got = append(got, strings.TrimPrefix(problem.String(), dir+"/"))
+	}
+	expected := []string{
+		"gocollect.conf:6: error: missing equals sign",
+		("gocollect.conf:2: error: unknown key push_ur1 " +
+			"(did you mean push_url?)"),
+		("gocollect.conf:1: warning: push_url is overridden at " +
+			dir + "/gocollect.conf:5"),
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s",
+			strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestEffective(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"gocollect.conf": ("push_url = http://a/\n" +
+			"collectors_path = /a\n" +
+			"include = local.conf\n"),
+		"local.conf": ("push_url = http://b/\n" +
+			"collectors_path = /b\n"),
+	})
+	defer os.RemoveAll(dir)
+
+	conf, err := Parse(filepath.Join(dir, "gocollect.conf"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := map[string]Key{
+		"push_url":        {},
+		"collectors_path": {Multi: true},
+		"run_interval":    {Default: "4h"},
+		"api_key":         {},
+	}
+	var buf strings.Builder
+	if err = WriteSettings(&buf, conf.Effective(known)); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Replace(buf.String(), dir+"/", "", -1)
+	expected := ("#api_key =            # not set\n" +
+		"collectors_path = /a  # gocollect.conf:2\n" +
+		"collectors_path = /b  # local.conf:2\n" +
+		"push_url = http://b/  # local.conf:1 " +
+		"(overrides gocollect.conf:1)\n" +
+		"run_interval = 4h     # default\n")
+	if got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestParse_Env(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"gocollect.conf": ("register_url = https://${HOST}/register\n" +
+			"push_url = https://${HOST:-localhost}/${PUSH}/{regid}\n" +
+			"api_key = $${literal}\n" +
+			"collectors_path = ${EMPTY:-/c}\n" +
+			"collectors_path = ${MISSING}/d\n"),
+	})
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{
+		"HOST":               "example.com",
+		"EMPTY":              "",
+		"GOCOLLECT_API_KEY":  "secret",
+		"GOCOLLECT_PUSH_URL": "https://override/",
+	}
+	conf, err := Parse(filepath.Join(dir, "gocollect.conf"), Options{
+		Known: map[string]Key{
+			"register_url":    {},
+			"push_url":        {},
+			"api_key":         {},
+			"collectors_path": {Multi: true},
+		},
+		LookupEnv: func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{
+		"register_url": "https://example.com/register",
+		"push_url":     "https://override/",
+		"api_key":      "secret",
+	} {
+		if value, _ := conf.Get(key); value != expected {
+			t.Errorf("%s: got %s", key, value)
+		}
+	}
+	if value := conf.Lookup("push_url")[0].Value; value !=
+		"https://example.com//{regid}" {
+		t.Errorf("push_url from file: got %s", value)
+	}
+	if value := conf.Lookup("api_key")[0].Value; value != "${literal}" {
+		t.Errorf("api_key from file: got %s", value)
+	}
+	if entry := conf.Lookup("api_key")[1]; entry.Pos() !=
+		"$GOCOLLECT_API_KEY" {
+		t.Errorf("api_key pos: got %s", entry.Pos())
+	}
+	paths := strings.Join(conf.Values("collectors_path"), ",")
+	if paths != "/c,/d" {
+		t.Errorf("collectors_path: got %s", paths)
+	}
+
+	var got []string
+	for _, problem := range conf.Problems {
+		got = append(got, strings.TrimPrefix(problem.String(), dir+"/"))
+	}
+	expected := ("gocollect.conf:2: warning: ${PUSH} is not set\n" +
+		"gocollect.conf:5: warning: ${MISSING} is not set")
+	if strings.Join(got, "\n") != expected {
+		t.Errorf("problems: got:\n%s", strings.Join(got, "\n"))
+	}
+}
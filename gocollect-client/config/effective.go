@@ -0,0 +1,93 @@
+// Package config (gocollect) reads the GoCollect configuration file.
+package config
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Setting is the effective value of a key, and where it came from.
+type Setting struct {
+	Key   string `json:"key"`
+	Multi bool   `json:"multi"`
+	// Values holds the last value for single-value keys, and all values
+	// for Multi keys. Empty if the key is not set and has no default.
+	Values []string `json:"values"`
+	// Sources holds the "file:line" of each value, or "default".
+	Sources []string `json:"sources"`
+	// Overridden holds the positions of the values that lost.
+	Overridden []string `json:"overridden,omitempty"`
+	// Unknown is set for keys that are not in the known keys.
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// Effective returns the settings of the known keys and of all keys in
+// the config, sorted by key.
+func (c *Config) Effective(known map[string]Key) []Setting {
+	keys := make(map[string]bool)
+	for key := range known {
+		keys[key] = true
+	}
+	for _, entry := range c.Entries {
+		keys[entry.Key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	settings := make([]Setting, 0, len(sorted))
+	for _, key := range sorted {
+		info, ok := known[key]
+		setting := Setting{
+			Key: key, Multi: info.Multi, Unknown: !ok,
+			Values: []string{}, Sources: []string{}}
+		entries := c.Lookup(key)
+		if !setting.Multi && len(entries) > 1 {
+			for _, entry := range entries[:len(entries)-1] {
+				setting.Overridden = append(setting.Overridden, entry.Pos())
+			}
+			entries = entries[len(entries)-1:]
+		}
+		for _, entry := range entries {
+			setting.Values = append(setting.Values, entry.Value)
+			setting.Sources = append(setting.Sources, entry.Pos())
+		}
+		if len(entries) == 0 && info.Default != "" {
+			setting.Values = append(setting.Values, info.Default)
+			setting.Sources = append(setting.Sources, "default")
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// WriteSettings writes the settings in config file syntax, with the
+// source of each value in a comment. Unset keys are commented out.
+func WriteSettings(w io.Writer, settings []Setting) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, setting := range settings {
+		note := ""
+		if setting.Unknown {
+			note = " (unknown key)"
+		}
+		if len(setting.Values) == 0 {
+			fmt.Fprintf(tw, "#%s =\t# not set%s\n", setting.Key, note)
+			continue
+		}
+		for i, value := range setting.Values {
+			source := setting.Sources[i]
+			if len(setting.Overridden) != 0 {
+				source += " (overrides " +
+					strings.Join(setting.Overridden, ", ") + ")"
+			}
+			fmt.Fprintf(tw, "%s = %s\t# %s%s\n",
+				setting.Key, value, source, note)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,92 @@
+// Package config (gocollect) reads the GoCollect configuration file.
+package config
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables that override
+// config keys: GOCOLLECT_PUSH_URL overrides push_url.
+const EnvPrefix = "GOCOLLECT_"
+
+// EnvName returns the name of the environment variable that overrides
+// the key.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(key)
+}
+
+func (p *parser) lookupEnv(name string) (string, bool) {
+	if p.opts.LookupEnv != nil {
+		return p.opts.LookupEnv(name)
+	}
+	return os.LookupEnv(name)
+}
+
+// expand replaces ${VAR} and ${VAR:-default} in the value of the entry
+// with the environment variable VAR. "$${" is a literal "${". Unset
+// variables without a default become empty, with a warning.
+func (p *parser) expand(entry Entry) string {
+	value := entry.Value
+	if !strings.Contains(value, "${") {
+		return value
+	}
+
+	var ret strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			break
+		}
+		if start > 0 && value[start-1] == '$' {
+			ret.WriteString(value[:start])
+			ret.WriteString("{")
+			value = value[start+2:]
+			continue
+		}
+		end := strings.IndexByte(value[start:], '}') + start
+		if end < start {
+			break // unterminated; leave it as is
+		}
+
+		ret.WriteString(value[:start])
+		name, fallback := value[start+2:end], ""
+		hasFallback := false
+		if i := strings.Index(name, ":-"); i >= 0 {
+			name, fallback, hasFallback = name[:i], name[i+2:], true
+		}
+		if env, ok := p.lookupEnv(name); ok && (env != "" || !hasFallback) {
+			ret.WriteString(env)
+		} else if hasFallback {
+			ret.WriteString(fallback)
+		} else {
+			p.conf.Problems = append(p.conf.Problems, Problem{
+				Pos: entry.Pos(), Warning: true,
+				Message: "${" + name + "} is not set"})
+		}
+		value = value[end+1:]
+	}
+	ret.WriteString(value)
+	return ret.String()
+}
+
+// applyEnv adds the GOCOLLECT_<KEY> environment overrides of the
+// single-value known keys after the other entries, so they win.
+func (p *parser) applyEnv() {
+	keys := make([]string, 0, len(p.opts.Known))
+	for key, info := range p.opts.Known {
+		if !info.Multi {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := EnvName(key)
+		if value, ok := p.lookupEnv(name); ok {
+			p.conf.Entries = append(p.conf.Entries, Entry{
+				Key: key, Value: value, File: "$" + name})
+		}
+	}
+}
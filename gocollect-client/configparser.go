@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	getopt "github.com/ossobv/go-getopt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/config"
+	"github.com/ossobv/gocollect/gocollect-client/data"
+	"github.com/ossobv/gocollect/gocollect-client/runner"
+	"github.com/ossobv/gocollect/gocollect-client/sanejoin"
+	"github.com/ossobv/gocollect/gocollect-client/shcollectors"
+)
+
+// configKeys are the keys that may be used in the config file, with
+// their defaults. The configParser uses the same defaults, so check-config
+// and print-config show what the daemon really uses.
+var configKeys = map[string]config.Key{
+	"api_key":                {},
+	"register_url":           {},
+	"push_url":               {},
+	"collectors_path":        {Multi: true},
+	"tls_cert_file":          {},
+	"tls_key_file":           {},
+	"tls_ca_file":            {},
+	"tls_server_name":        {},
+	"outbox_path":            {Default: "/var/lib/gocollect/outbox"},
+	"outbox_max_age":         {Default: "168h"},
+	"outbox_max_size":        {Default: "33554432"}, // 32 MiB
+	"push_unchanged":         {Default: runner.PushUnchangedAlways},
+	"push_full_interval":     {Default: "24h"},
+	"run_interval":           {Default: "4h"},
+	"collector_interval":     {Multi: true},
+	"collectors_timeout":     {Default: shcollectors.DefaultTimeout.String()},
+	"collector_timeout":      {Multi: true},
+	"collector_enable":       {Multi: true},
+	"collector_disable":      {Multi: true},
+	"collector_args":         {Multi: true},
+	"collector_env":          {Multi: true},
+	"keep_stderr":            {Default: "no"},
+	"collectors_concurrency": {Default: "1"},
+	"push_encoding":          {Default: runner.PushEncodingIdentity},
+	"control_socket":         {Default: "/var/run/gocollect.sock"},
+	"metrics_listen":         {},
+	"metrics_textfile":       {},
+	"lock_file":              {Default: "/var/lib/gocollect/gocollect.lock"},
+	"shutdown_grace":         {Default: "30s"},
+}
+
+func parseConfigOrExit(options map[string]getopt.OptionValue) *config.Config {
+	conf, e := parseConfig(options["config"].String, options)
+	if e != nil {
+		fmt.Fprintf(
+			os.Stderr, "%s: %s\n\nSee --help for more info.\n",
+			filepath.Base(os.Args[0]), e.Error())
+		os.Exit(1)
+	}
+	for _, problem := range conf.Problems {
+		fmt.Fprintf(os.Stderr, "%s\n", problem)
+	}
+	return conf
+}
+
+func parseConfig(
+	filename string,
+	options map[string]getopt.OptionValue) (*config.Config, error) {
+
+	return config.Parse(filename, config.Options{
+		StrictIncludes: options["strict-includes"].Bool,
+		Known:          configKeys})
+}
+
+// configParser extracts typed values from the config. Errors are
+// collected instead of returned, so they can all be reported at once.
+type configParser struct {
+	conf     *config.Config
+	problems []config.Problem
+}
+
+// fail records a bad value, at the position of the entry that set it.
+func (cp *configParser) fail(key string, value string, e error) {
+	pos := cp.conf.Filename
+	for _, entry := range cp.conf.Lookup(key) {
+		if entry.Value == value {
+			pos = entry.Pos()
+		}
+	}
+	cp.problems = append(cp.problems, config.Problem{
+		Pos: pos, Message: fmt.Sprintf("%s = %s: %s", key, value, e)})
+}
+
+// getString returns the value of key, or its default.
+func (cp *configParser) getString(key string) string {
+	if value, ok := cp.conf.Get(key); ok {
+		return value
+	}
+	return configKeys[key].Default
+}
+
+// getPath returns the value of key like getString, but a relative path
+// is made relative to the file that set it: that may be an included
+// file in another directory. (Relative paths from the environment are
+// left for the Runner to resolve against the main config file.)
+func (cp *configParser) getPath(key string) string {
+	entries := cp.conf.Lookup(key)
+	if len(entries) == 0 {
+		return configKeys[key].Default
+	}
+	entry := entries[len(entries)-1]
+	if entry.Value == "" || entry.Line == 0 {
+		return entry.Value
+	}
+	return sanejoin.Join(filepath.Dir(entry.File), entry.Value)
+}
+
+// parse calls parseValue with the value of key. If it is not set (or
+// empty), or if it is bad, parseValue gets the default instead.
+func (cp *configParser) parse(key string, parseValue func(string) error) {
+	if value, _ := cp.conf.Get(key); value != "" {
+		e := parseValue(value)
+		if e == nil {
+			return
+		}
+		cp.fail(key, value, e)
+	}
+	if value := configKeys[key].Default; value != "" {
+		if e := parseValue(value); e != nil {
+			panic("default " + key + " = " + value + ": " + e.Error())
+		}
+	}
+}
+
+func (cp *configParser) getChoice(key string, choices ...string) (ret string) {
+	cp.parse(key, func(value string) error {
+		for _, choice := range choices {
+			if value == choice {
+				ret = value
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of: %s", strings.Join(choices, ", "))
+	})
+	return ret
+}
+
+func (cp *configParser) getDuration(key string) (ret time.Duration) {
+	cp.parse(key, func(value string) (e error) {
+		ret, e = time.ParseDuration(value)
+		return e
+	})
+	return ret
+}
+
+func (cp *configParser) getInt(key string) (ret int64) {
+	cp.parse(key, func(value string) (e error) {
+		ret, e = strconv.ParseInt(value, 10, 64)
+		return e
+	})
+	return ret
+}
+
+func (cp *configParser) getBool(key string) (ret bool) {
+	cp.parse(key, func(value string) error {
+		switch strings.ToLower(value) {
+		case "yes", "true", "on", "1":
+			ret = true
+		case "no", "false", "off", "0":
+			ret = false
+		default:
+			return errors.New("expected yes or no")
+		}
+		return nil
+	})
+	return ret
+}
+
+// getKeyDurations parses "KEY DURATION" values, where KEY is a
+// collector key or glob.
+func (cp *configParser) getKeyDurations(key string) (ret runner.KeyDurations) {
+	for _, value := range cp.conf.Values(key) {
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			cp.fail(key, value, errors.New("expected KEY DURATION"))
+			continue
+		}
+		if _, e := filepath.Match(fields[0], ""); e != nil {
+			cp.fail(key, value, e)
+			continue
+		}
+		duration, e := time.ParseDuration(fields[1])
+		if e != nil {
+			cp.fail(key, value, e)
+			continue
+		}
+		ret = append(ret, runner.KeyDuration{
+			Pattern: fields[0], Duration: duration})
+	}
+	return ret
+}
+
+// getPattern splits a "KEY REST" value, where KEY is a collector key or
+// glob. REST may be empty.
+func (cp *configParser) getPattern(
+	key string, value string) (pattern string, rest string, ok bool) {
+
+	pattern = value
+	if i := strings.IndexAny(value, " \t"); i >= 0 {
+		pattern, rest = value[:i], strings.TrimSpace(value[i+1:])
+	}
+	if _, e := filepath.Match(pattern, ""); e != nil {
+		cp.fail(key, value, e)
+		return "", "", false
+	}
+	return pattern, rest, true
+}
+
+// getToggles parses the collector_enable and collector_disable values,
+// in order.
+func (cp *configParser) getToggles() (ret []runner.CollectorToggle) {
+	for _, entry := range cp.conf.Entries {
+		if entry.Key != "collector_enable" &&
+			entry.Key != "collector_disable" {
+			continue
+		}
+		pattern, rest, ok := cp.getPattern(entry.Key, entry.Value)
+		if !ok {
+			continue
+		} else if pattern == "" || rest != "" {
+			cp.fail(entry.Key, entry.Value, errors.New("expected KEY"))
+			continue
+		}
+		ret = append(ret, runner.CollectorToggle{
+			Pattern: pattern, Enable: entry.Key == "collector_enable",
+			Source: entry.Pos()})
+	}
+	return ret
+}
+
+// isBuiltin returns true if the pattern is the key of a builtin
+// collector that no script overrides. Those have no use for arguments
+// or environment.
+func (cp *configParser) isBuiltin(pattern string) bool {
+	if _, ok := data.BuiltinCollectors[pattern]; !ok {
+		return false
+	}
+	scripts := shcollectors.Find(cp.conf.Values("collectors_path"))
+	_, ok := (*scripts)[pattern]
+	return !ok
+}
+
+// getKeyArgs parses "KEY ARGS..." values. The arguments are split on
+// whitespace.
+func (cp *configParser) getKeyArgs(key string) (ret []runner.KeyArgs) {
+	for _, value := range cp.conf.Values(key) {
+		pattern, rest, ok := cp.getPattern(key, value)
+		if !ok {
+			continue
+		} else if cp.isBuiltin(pattern) {
+			cp.fail(key, value, errors.New(
+				"builtin collectors take no arguments"))
+			continue
+		}
+		ret = append(ret, runner.KeyArgs{
+			Pattern: pattern, Args: strings.Fields(rest)})
+	}
+	return ret
+}
+
+// getKeyEnv parses "KEY NAME=VALUE" values.
+func (cp *configParser) getKeyEnv(key string) (ret []runner.KeyEnv) {
+	for _, value := range cp.conf.Values(key) {
+		pattern, rest, ok := cp.getPattern(key, value)
+		if !ok {
+			continue
+		} else if strings.IndexByte(rest, '=') < 1 {
+			cp.fail(key, value, errors.New("expected KEY NAME=VALUE"))
+			continue
+		} else if cp.isBuiltin(pattern) {
+			cp.fail(key, value, errors.New(
+				"builtin collectors take no environment"))
+			continue
+		}
+		ret = append(ret, runner.KeyEnv{Pattern: pattern, Env: rest})
+	}
+	return ret
+}
+
+func createCollectRunnerOrExit(
+	options map[string]getopt.OptionValue, conf *config.Config) runner.Runner {
+
+	ret, problems := createCollectRunner(options, conf)
+	exitOnConfigErrors(problems)
+	return ret
+}
+
+func exitOnConfigErrors(problems []config.Problem) {
+	if len(problems) != 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(
+				os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), problem)
+		}
+		os.Exit(1)
+	}
+}
+
+func createCollectRunner(
+	options map[string]getopt.OptionValue, conf *config.Config) (
+	ret runner.Runner, problems []config.Problem) {
+
+	cp := configParser{conf: conf}
+
+	// Take options and config and extract relevant values.
+	ret.APIKey = cp.getString("api_key")
+	ret.RegisterURL = cp.getString("register_url")
+	ret.PushURL = cp.getString("push_url")
+	ret.ConfigPathBase = conf.Dir()
+	ret.CollectorsPaths = conf.Values("collectors_path")
+	ret.RegidFilename = defaultRegidFilename
+	ret.GoCollectVersion = versionStr
+
+	// Optional TLS client certificate and private CA.
+	ret.TLSCertFile = cp.getPath("tls_cert_file")
+	ret.TLSKeyFile = cp.getPath("tls_key_file")
+	ret.TLSCAFile = cp.getPath("tls_ca_file")
+	ret.TLSServerName = cp.getString("tls_server_name")
+
+	// Outbox for undelivered pushes; an empty path disables it.
+	ret.OutboxPath = cp.getString("outbox_path")
+	ret.OutboxMaxAge = cp.getDuration("outbox_max_age")
+	ret.OutboxMaxSize = cp.getInt("outbox_max_size")
+
+	// Skip pushing unchanged data.
+	ret.StateFilename = defaultStateFilename
+	ret.PushUnchanged = cp.getChoice(
+		"push_unchanged", runner.PushUnchangedAlways, runner.PushUnchangedSkip,
+		runner.PushUnchangedConditional)
+	ret.PushFullInterval = cp.getDuration("push_full_interval")
+
+	// Run intervals; globally and per collector.
+	ret.RunInterval = cp.getDuration("run_interval")
+	ret.CollectorIntervals = cp.getKeyDurations("collector_interval")
+
+	// Collector time limits; globally and per collector.
+	ret.CollectorTimeout = cp.getDuration("collectors_timeout")
+	ret.CollectorTimeouts = cp.getKeyDurations("collector_timeout")
+
+	// Enable, disable and configure individual collectors.
+	ret.CollectorToggles = cp.getToggles()
+	ret.CollectorArgs = cp.getKeyArgs("collector_args")
+	ret.CollectorEnv = cp.getKeyEnv("collector_env")
+
+	// Keep collector stderr in the state file?
+	ret.KeepStderr = cp.getBool("keep_stderr")
+	ret.StderrLogLimit = shcollectors.DefaultStderrLogLimit
+
+	// Run collectors concurrently?
+	ret.Concurrency = int(cp.getInt("collectors_concurrency"))
+
+	// Optionally compress pushed data.
+	ret.PushEncoding = cp.getChoice(
+		"push_encoding", runner.PushEncodingIdentity, runner.PushEncodingGzip,
+		runner.PushEncodingZstd)
+
+	return ret, cp.problems
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	getopt "github.com/ossobv/go-getopt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/config"
+	"github.com/ossobv/gocollect/gocollect-client/runner"
+)
+
+func parseTestConfig(t *testing.T, contents string) *config.Config {
+	dir, e := ioutil.TempDir("", "gocollect-config-")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, "gocollect.conf")
+	ioutil.WriteFile(filename, []byte(contents), 0644)
+	conf, e := parseConfig(filename, map[string]getopt.OptionValue{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	return conf
+}
+
+func TestCreateCollectRunner_Defaults(t *testing.T) {
+	conf := parseTestConfig(t, "")
+	ret, problems := createCollectRunner(nil, conf)
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	assertEqual(t, ret.OutboxPath, "/var/lib/gocollect/outbox", "")
+	assertEqual(t, ret.OutboxMaxAge, 7*24*time.Hour, "")
+	assertEqual(t, ret.OutboxMaxSize, int64(32*1024*1024), "")
+	assertEqual(t, ret.PushUnchanged, runner.PushUnchangedAlways, "")
+	assertEqual(t, ret.RunInterval, 4*time.Hour, "")
+	assertEqual(t, ret.KeepStderr, false, "")
+	assertEqual(t, ret.Concurrency, 1, "")
+	assertEqual(t, ret.PushEncoding, runner.PushEncodingIdentity, "")
+
+	// The effective config shows the same defaults.
+	cp := configParser{conf: conf}
+	for _, setting := range conf.Effective(configKeys) {
+		if !setting.Multi && len(setting.Values) == 1 {
+			assertEqual(t, cp.getString(setting.Key), setting.Values[0],
+				setting.Key)
+		}
+	}
+}
+
+func TestCreateCollectRunner_BadValues(t *testing.T) {
+	conf := parseTestConfig(t, "run_interval = often\n"+
+		"keep_stderr = maybe\npush_encoding = rot13\n"+
+		"collectors_concurrency = 4\n")
+	ret, problems := createCollectRunner(nil, conf)
+
+	// Bad values are reported and replaced by the default.
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Message)
+	}
+	assertEqual(t, len(messages), 3, strings.Join(messages, "\n"))
+	assertEqual(t, ret.RunInterval, 4*time.Hour, "")
+	assertEqual(t, ret.KeepStderr, false, "")
+	assertEqual(t, ret.PushEncoding, runner.PushEncodingIdentity, "")
+	assertEqual(t, ret.Concurrency, 4, "")
+}
+
+func TestCreateCollectRunner_TLSPaths(t *testing.T) {
+	conf := parseTestConfig(t, "tls_ca_file = ca.crt\n"+
+		"tls_key_file = /etc/gocollect/client.key\ninclude = conf.d\n")
+	dir := filepath.Dir(conf.Filename)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "tls.conf"),
+		[]byte("tls_cert_file = client.crt\n"), 0644)
+	conf, e := parseConfig(conf.Filename, map[string]getopt.OptionValue{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	ret, problems := createCollectRunner(nil, conf)
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	// Relative to the file that sets them.
+	assertEqual(t, ret.TLSCAFile, filepath.Join(dir, "ca.crt"), "")
+	assertEqual(t, ret.TLSCertFile,
+		filepath.Join(dir, "conf.d", "client.crt"), "")
+	assertEqual(t, ret.TLSKeyFile, "/etc/gocollect/client.key", "")
+}
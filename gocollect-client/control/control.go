@@ -0,0 +1,175 @@
+// Package control (gocollect) implements the local control socket of
+// the GoCollect daemon, and the client that talks to it.
+//
+// The protocol is line based. The client sends a single line with a
+// command and optional space separated arguments:
+//
+//	run               run all collectors now
+//	run KEY...        run the collectors and push their data
+//	status            show the daemon status
+//	next              show when the next run is scheduled
+//	reload            reload the configuration file
+//
+// The daemon replies with a single line of JSON:
+//
+//	{"ok":true,"message":"...","data":{...}}
+//
+// and closes the connection.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Request is a single command sent to the daemon.
+type Request struct {
+	Command string
+	Args    []string
+}
+
+// Response is the reply of the daemon.
+type Response struct {
+	OK      bool        `json:"ok"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Handler handles a request. It is called from the goroutine serving
+// the connection, so it must be safe for concurrent use.
+type Handler func(req Request) Response
+
+// Server listens on the control socket.
+type Server struct {
+	path     string
+	listener net.Listener
+	handler  Handler
+}
+
+// Maximum time a client gets to send its request.
+const readTimeout = 10 * time.Second
+
+// Listen creates the control socket and starts serving it in the
+// background. Only root (and the user the daemon runs as) may connect.
+func Listen(path string, handler Handler) (*Server, error) {
+	// Remove a stale socket, but only if nothing answers there. Leave
+	// anything that is not a socket alone: that's a config mistake.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New(path + ": already in use")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + ": exists and is not a socket")
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only our own user may connect. (checkPeer lets root in too.)
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &Server{path: path, listener: listener, handler: handler}
+	go s.serve()
+	return s, nil
+}
+
+// Close stops listening and removes the socket.
+func (s *Server) Close() {
+	s.listener.Close() // also removes the socket file
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return // closed
+		}
+		go s.serveConn(conn.(*net.UnixConn))
+	}
+}
+
+func (s *Server) serveConn(conn *net.UnixConn) {
+	defer conn.Close()
+
+	var resp Response
+	if err := checkPeer(conn); err != nil {
+		resp = Response{Message: err.Error()}
+	} else {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		fields := strings.Fields(line)
+		if err != nil && len(fields) == 0 {
+			return
+		} else if len(fields) == 0 {
+			resp = Response{Message: "empty request"}
+		} else {
+			resp = s.handler(Request{Command: fields[0], Args: fields[1:]})
+		}
+	}
+
+	encoded, _ := json.Marshal(&resp)
+	conn.Write(append(encoded, '\n'))
+}
+
+// checkPeer allows only root and our own user.
+func checkPeer(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return err
+	}
+	if cred.Uid != 0 && cred.Uid != uint32(os.Getuid()) {
+		return errors.New("permission denied")
+	}
+	return nil
+}
+
+// Send sends the request to the daemon listening on path and returns
+// its response.
+func Send(path string, req Request, timeout time.Duration) (
+	resp Response, err error) {
+
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	line := strings.Join(append([]string{req.Command}, req.Args...), " ")
+	if _, err = conn.Write([]byte(line + "\n")); err != nil {
+		return resp, err
+	}
+	reply, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(reply) == 0 {
+		return resp, err
+	}
+	err = json.Unmarshal(reply, &resp)
+	return resp, err
+}
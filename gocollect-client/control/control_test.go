@@ -0,0 +1,128 @@
+package control
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSocket(t *testing.T) string {
+	path, err := ioutil.TempDir("", "gocollect-control-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	return filepath.Join(path, "control.sock")
+}
+
+func TestListenAndSend(t *testing.T) {
+	path := newTestSocket(t)
+	requests := make(chan Request, 1)
+	server, err := Listen(path, func(req Request) Response {
+		requests <- req
+		return Response{OK: true, Message: "hello",
+			Data: map[string]int{"answer": 42}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if st.Mode().Perm() != 0600 {
+		t.Errorf("got mode %o, expected 0600", st.Mode().Perm())
+	}
+
+	resp, err := Send(path, Request{"run", []string{"os.pkg", "app.x"}},
+		time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Response{OK: true, Message: "hello",
+		Data: map[string]interface{}{"answer": float64(42)}}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("got response %+v, expected %+v", resp, expected)
+	}
+	req := <-requests
+	if req.Command != "run" ||
+		!reflect.DeepEqual(req.Args, []string{"os.pkg", "app.x"}) {
+		t.Errorf("got request %+v", req)
+	}
+
+	// Another daemon may not take over the socket.
+	if _, err := Listen(path, nil); err == nil {
+		t.Errorf("expected the socket to be in use")
+	}
+
+	server.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket was not removed: %v", err)
+	}
+	_, err = Send(path, Request{Command: "status"}, time.Second)
+	if err == nil {
+		t.Errorf("expected an error after Close")
+	}
+}
+
+func TestListen_StaleSocket(t *testing.T) {
+	path := newTestSocket(t)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	server, err := Listen(path, func(req Request) Response {
+		return Response{OK: true}
+	})
+	if err != nil {
+		t.Fatalf("stale socket was not replaced: %s", err)
+	}
+	defer server.Close()
+	resp, err := Send(path, Request{Command: "status"}, time.Second)
+	if err != nil || !resp.OK {
+		t.Errorf("got %+v, %v", resp, err)
+	}
+}
+
+func TestListen_NotASocket(t *testing.T) {
+	path := newTestSocket(t)
+	if err := ioutil.WriteFile(path, []byte("keep me\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Listen(path, func(req Request) Response {
+		return Response{OK: true}
+	})
+	if err == nil || err.Error() != path+": exists and is not a socket" {
+		t.Errorf("expected not a socket, got %v", err)
+	}
+	if contents, _ := ioutil.ReadFile(path); string(contents) != "keep me\n" {
+		t.Errorf("file was touched: %q", contents)
+	}
+}
+
+func TestServer_EmptyRequest(t *testing.T) {
+	path := newTestSocket(t)
+	server, err := Listen(path, func(req Request) Response {
+		t.Errorf("handler called for an empty request")
+		return Response{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	resp, err := Send(path, Request{Command: " "}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.OK || resp.Message != "empty request" {
+		t.Errorf("got %+v, expected an empty request error", resp)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	getopt "github.com/ossobv/go-getopt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/config"
+	"github.com/ossobv/gocollect/gocollect-client/control"
+	"github.com/ossobv/gocollect/gocollect-client/log"
+	"github.com/ossobv/gocollect/gocollect-client/metrics"
+	"github.com/ossobv/gocollect/gocollect-client/runner"
+	"github.com/ossobv/gocollect/gocollect-client/sdnotify"
+	"github.com/ossobv/gocollect/gocollect-client/signal"
+)
+
+var metricRetryBackoff = metrics.NewGauge(
+	"gocollect_retry_backoff_seconds",
+	"Retry interval after failed runs; 0 if the last run succeeded.")
+
+// startupKeys are read once, when the daemon starts. A reload cannot
+// apply them; it warns that a restart is needed instead.
+var startupKeys = []string{
+	"control_socket", "lock_file", "metrics_listen", "shutdown_grace",
+}
+
+// daemon holds the state of the running daemon, for the control
+// socket.
+type daemon struct {
+	runner          *runner.Runner
+	options         map[string]getopt.OptionValue
+	configFile      string // absolute, because we chdir
+	metricsTextfile string
+	startupValues   map[string]string
+	requests        chan daemonRequest
+
+	// Closed on TERM/INT: don't start anything new. The context is
+	// cancelled after the grace period: abort what is running.
+	stop   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The systemd watchdog interval, or 0 if it is not enabled.
+	watchdogInterval time.Duration
+
+	mutex       sync.Mutex
+	running     bool
+	lastRun     time.Time
+	lastSuccess bool
+	nextRun     time.Time
+}
+
+// daemonRequest is a control request that is handled by the main loop.
+type daemonRequest struct {
+	req   control.Request
+	reply chan control.Response
+}
+
+func newDaemon(
+	collectRunner *runner.Runner, options map[string]getopt.OptionValue,
+	conf *config.Config) *daemon {
+
+	configFile, e := filepath.Abs(options["config"].String)
+	if e != nil {
+		configFile = options["config"].String
+	}
+	cp := configParser{conf: conf}
+	d := &daemon{
+		runner:          collectRunner,
+		options:         options,
+		configFile:      configFile,
+		metricsTextfile: cp.getString("metrics_textfile"),
+		startupValues:   make(map[string]string),
+		requests:        make(chan daemonRequest),
+		stop:            make(chan struct{}),
+	}
+	for _, key := range startupKeys {
+		d.startupValues[key] = cp.getString(key)
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.attach(collectRunner)
+	return d
+}
+
+// attach hooks the runner up to the daemon.
+func (d *daemon) attach(collectRunner *runner.Runner) {
+	collectRunner.Progress = d.progress
+	collectRunner.Stop = d.stop
+	collectRunner.Context = d.ctx
+}
+
+// shutdownOnSignal waits for TERM or INT. Then it stops the daemon,
+// giving the running collector and push the grace period to finish.
+// A second signal aborts right away.
+func (d *daemon) shutdownOnSignal(sigs chan os.Signal, grace time.Duration) {
+	sig := <-sigs
+	log.Log.Printf("Got %s; shutting down", sig.String())
+	sdnotify.Stopping()
+	close(d.stop)
+
+	select {
+	case sig = <-sigs:
+		log.Log.Printf("Got %s again; aborting", sig.String())
+	case <-time.After(grace):
+		log.Log.Printf("shutdown: grace period of %s expired; aborting",
+			grace)
+	}
+	d.cancel()
+}
+
+// abortOnSignal waits for TERM or INT, and then aborts the one-off
+// command (collect, register, export or a dry run) right away: the
+// running collectors are killed and the command fails. A second signal
+// exits immediately.
+func (d *daemon) abortOnSignal(sigs chan os.Signal) {
+	sig := <-sigs
+	log.Log.Printf("Got %s; aborting", sig.String())
+	close(d.stop)
+	d.cancel()
+
+	sig = <-sigs
+	log.Log.Printf("Got %s again; exiting", sig.String())
+	os.Exit(1)
+}
+
+func (d *daemon) isStopping() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// handle is the control socket handler. Status requests are answered
+// right away; the rest is passed to the main loop.
+func (d *daemon) handle(req control.Request) control.Response {
+	switch req.Command {
+	case "status":
+		return control.Response{OK: true, Data: d.status()}
+	case "next":
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		return control.Response{
+			OK: true, Message: d.nextRun.Format(time.RFC3339)}
+	case "run", "reload":
+		if len(req.Args) != 0 && req.Command == "reload" {
+			return control.Response{Message: "reload takes no arguments"}
+		}
+	default:
+		return control.Response{Message: "unknown command: " + req.Command}
+	}
+
+	d.mutex.Lock()
+	running := d.running
+	d.mutex.Unlock()
+	if running {
+		return control.Response{Message: "busy running collectors"}
+	}
+
+	dr := daemonRequest{req: req, reply: make(chan control.Response, 1)}
+	select {
+	case d.requests <- dr:
+	case <-time.After(5 * time.Second):
+		return control.Response{Message: "busy"}
+	}
+	return <-dr.reply
+}
+
+func (d *daemon) status() map[string]interface{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ret := map[string]interface{}{
+		"pid":          os.Getpid(),
+		"version":      versionStr,
+		"running":      d.running,
+		"last_success": d.lastSuccess,
+		"next_run":     d.nextRun,
+	}
+	if !d.lastRun.IsZero() {
+		ret["last_run"] = d.lastRun
+	}
+	return ret
+}
+
+// run runs the collectors (all, or only the ones that are due) while
+// keeping the status up to date.
+func (d *daemon) run(runAll bool) bool {
+	d.mutex.Lock()
+	d.running = true
+	d.lastRun = time.Now()
+	d.mutex.Unlock()
+
+	var ret bool
+	if runAll {
+		ret = d.runner.Run()
+	} else {
+		ret = d.runner.RunDue()
+	}
+
+	d.mutex.Lock()
+	d.running = false
+	d.lastSuccess = ret
+	d.mutex.Unlock()
+	return ret
+}
+
+// runKeys runs only the selected collectors.
+func (d *daemon) runKeys(keys []string) control.Response {
+	runnable := make(map[string]bool)
+	for _, key := range d.runner.Runnable() {
+		runnable[key] = true
+	}
+	for _, key := range keys {
+		if !runnable[key] {
+			return control.Response{Message: "no such collector: " + key}
+		}
+	}
+
+	log.Log.Printf("control: running %s", strings.Join(keys, ", "))
+	d.mutex.Lock()
+	d.running = true
+	d.mutex.Unlock()
+	ret := d.runner.RunCollectors(keys)
+	d.mutex.Lock()
+	d.running = false
+	d.mutex.Unlock()
+	d.writeMetrics()
+
+	if !ret {
+		return control.Response{Message: "run failed; see the log"}
+	}
+	return control.Response{OK: true, Message: "done"}
+}
+
+// reload re-reads the config file. If it is invalid, we keep running
+// with the old config.
+func (d *daemon) reload() control.Response {
+	conf, e := parseConfig(d.configFile, d.options)
+	if e != nil {
+		log.Log.Printf("reload: keeping the old config: %s", e)
+		return control.Response{Message: e.Error()}
+	}
+	for _, problem := range conf.Problems {
+		log.Log.Printf("reload: %s", problem)
+	}
+	collectRunner, problems := createCollectRunner(d.options, conf)
+	if len(problems) != 0 {
+		messages := make([]string, len(problems))
+		for i, problem := range problems {
+			log.Log.Printf("reload: keeping the old config: %s", problem)
+			messages[i] = problem.String()
+		}
+		return control.Response{Message: strings.Join(messages, "\n")}
+	}
+
+	// The runner pointer is shared with runnerinst; only the main
+	// loop uses it, so we can simply overwrite it. The collector paths
+	// are scanned again on every run.
+	d.attach(&collectRunner)
+	*d.runner = collectRunner
+	cp := configParser{conf: conf}
+	d.metricsTextfile = cp.getString("metrics_textfile")
+	d.checkWatchdog()
+
+	message := fmt.Sprintf("reloaded %s; %d collectors",
+		d.configFile, len(collectRunner.Runnable()))
+	log.Log.Printf("reload: %s", message)
+	if changed := d.changedStartupKeys(cp); len(changed) != 0 {
+		warning := fmt.Sprintf("restart gocollect to apply %s",
+			strings.Join(changed, ", "))
+		log.Log.Printf("reload: %s", warning)
+		message += "; " + warning
+	}
+	return control.Response{OK: true, Message: message}
+}
+
+// changedStartupKeys returns the startupKeys that have a different
+// value in the reloaded config.
+func (d *daemon) changedStartupKeys(cp configParser) []string {
+	var changed []string
+	for _, key := range startupKeys {
+		if cp.getString(key) != d.startupValues[key] {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// schedule sets the alarm for the next run.
+func (d *daemon) schedule(interval int) {
+	signal.Alarm(interval)
+	nextRun := time.Now().Add(time.Duration(interval) * time.Second)
+	d.runner.SetNextRun(nextRun)
+	d.setNextRun(nextRun)
+}
+
+func (d *daemon) setNextRun(t time.Time) {
+	d.mutex.Lock()
+	d.nextRun = t
+	lastSuccess := d.lastSuccess
+	d.mutex.Unlock()
+
+	if lastSuccess {
+		sdnotify.Status("idle; next run at %s", t.Format(time.RFC3339))
+	} else {
+		sdnotify.Status(
+			"last run failed; retry at %s", t.Format(time.RFC3339))
+	}
+}
+
+// progress is the Runner.Progress hook. It shows what we're doing in
+// systemctl status. While a run is busy, the main loop cannot ping the
+// watchdog; we do that here instead.
+func (d *daemon) progress(status string) {
+	sdnotify.Status("%s", status)
+	d.pingWatchdog()
+}
+
+// pingWatchdog tells systemd that we're alive. It is only called by
+// the main loop and during runs, so a wedged main loop (or a run that
+// makes no progress) stops the pings, and systemd restarts us.
+func (d *daemon) pingWatchdog() {
+	if d.watchdogInterval > 0 {
+		sdnotify.Watchdog()
+	}
+}
+
+// checkWatchdog warns if a collector may run longer than the watchdog
+// interval: during that time there is no progress to ping for.
+func (d *daemon) checkWatchdog() {
+	if d.watchdogInterval <= 0 {
+		return
+	}
+	if maxStall := d.runner.MaxStall(); maxStall == 0 {
+		log.Log.Printf("watchdog: some collectors have no timeout; " +
+			"systemd may restart gocollect while they run")
+	} else if maxStall > d.watchdogInterval {
+		log.Log.Printf("watchdog: a collector (and push) may take %s, "+
+			"longer than WatchdogSec %s; systemd may restart gocollect "+
+			"while it runs", maxStall, d.watchdogInterval)
+	}
+}
+
+// writeMetrics updates the node_exporter textfile, if configured.
+func (d *daemon) writeMetrics() {
+	if d.metricsTextfile == "" {
+		return
+	}
+	if e := metrics.WriteTextfile(d.metricsTextfile); e != nil {
+		log.Log.Printf("metrics: %s", e)
+	}
+}
+
+// serveMetrics starts the metrics HTTP listener, if configured.
+// Failure is not fatal.
+func serveMetrics(conf *config.Config) io.Closer {
+	cp := configParser{conf: conf}
+	addr := cp.getString("metrics_listen")
+	if addr == "" {
+		return nil
+	}
+	server, e := metrics.Serve(addr)
+	if e != nil {
+		log.Log.Printf("metrics: %s", e)
+		return nil
+	}
+	return server
+}
+
+// listenControl opens the control socket. Failure is not fatal; the
+// daemon can do without.
+func listenControl(conf *config.Config, d *daemon) *control.Server {
+	cp := configParser{conf: conf}
+	path := cp.getString("control_socket")
+	if path == "" {
+		return nil
+	}
+	server, e := control.Listen(path, d.handle)
+	if e != nil {
+		log.Log.Printf("control: %s", e)
+		return nil
+	}
+	return server
+}
+
+// loop runs the collectors, and then waits for the next run, a signal
+// or a control request. In one-shot mode, it returns after one run.
+// Returns the exit code.
+func (d *daemon) loop(
+	conf *config.Config, sigHandler signal.Handler, oneShot bool) int {
+
+	// The watchdog is pinged from the main loop, below, and from the
+	// run progress.
+	var watchdogTick <-chan time.Time
+	if !oneShot {
+		if server := listenControl(conf, d); server != nil {
+			defer server.Close()
+		}
+		if server := serveMetrics(conf); server != nil {
+			defer server.Close()
+		}
+		d.watchdogInterval = sdnotify.WatchdogInterval()
+		if d.watchdogInterval > 0 {
+			d.checkWatchdog()
+			ticker := time.NewTicker(d.watchdogInterval / 2)
+			defer ticker.Stop()
+			watchdogTick = ticker.C
+		}
+		sdnotify.Ready()
+	}
+	var interval int
+	last_success := true
+	// The first run of the daemon only runs the collectors that are
+	// due. When woken up by a signal, we run all of them.
+	runAll := oneShot
+	doRun := true
+	reloaded := false
+	for {
+		if doRun {
+			ret := d.run(runAll)
+			if d.isStopping() {
+				d.writeMetrics()
+				log.Log.Printf("Shutdown complete")
+				if oneShot {
+					return 1
+				}
+				return 0
+			}
+			if oneShot {
+				d.writeMetrics()
+				if !ret {
+					log.Log.Print("CollectRunner.Run() returned false")
+					return 1
+				}
+				return 0
+			}
+
+			if ret {
+				// All good, run again when the next collector is due
+				interval = secondsUntil(d.runner.NextRun())
+				last_success = true
+			} else if last_success {
+				// Retry in 5 minutes if this is the first run
+				interval = 300
+				last_success = false
+			} else {
+				// Keep retrying in larger intervals
+				interval *= 2
+				if interval > (4 * 3600) {
+					// Until we're at max
+					interval = 4 * 3600
+				}
+			}
+
+			if last_success {
+				metricRetryBackoff.Set(0)
+			} else {
+				metricRetryBackoff.Set(float64(interval))
+			}
+			d.writeMetrics()
+			d.schedule(interval)
+		} else if reloaded && last_success {
+			// The run intervals may have changed.
+			interval = secondsUntil(d.runner.NextRun())
+			d.schedule(interval)
+		}
+
+		// Wait for SIGALRM, SIGHUP or SIGUSR1, or a control request.
+		// Ping the watchdog in the meantime.
+		doRun = false
+		runAll = false
+		reloaded = false
+		select {
+		case <-watchdogTick:
+			d.pingWatchdog()
+		case <-d.stop:
+			log.Log.Printf("Shutdown complete")
+			return 0
+		case sig := <-sigHandler.Chan:
+			switch sig {
+			case syscall.SIGALRM:
+				doRun = true
+			case syscall.SIGHUP:
+				log.Log.Printf("Got %s; reloading config", sig.String())
+				reloaded = d.reload().OK
+			default:
+				signal.Alarm(0)
+				log.Log.Printf("Got %s to wake up early", sig.String())
+				doRun = true
+				runAll = true
+			}
+		case dr := <-d.requests:
+			switch {
+			case dr.req.Command == "reload":
+				resp := d.reload()
+				reloaded = resp.OK
+				dr.reply <- resp
+			case len(dr.req.Args) != 0:
+				dr.reply <- d.runKeys(dr.req.Args)
+			default:
+				dr.reply <- control.Response{
+					OK: true, Message: "running all collectors"}
+				signal.Alarm(0)
+				log.Log.Printf("control: running all collectors")
+				doRun = true
+				runAll = true
+			}
+		}
+	}
+}
+
+// secondsUntil returns the number of seconds until t, for use with
+// signal.Alarm. It is at least a minute and at most a day.
+func secondsUntil(t time.Time) int {
+	seconds := int(time.Until(t).Seconds()) + 1
+	if seconds < 60 {
+		return 60
+	} else if seconds > 86400 {
+		return 86400
+	}
+	return seconds
+}
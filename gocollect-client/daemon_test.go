@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	golog "log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ossobv/gocollect/gocollect-client/log"
+	"github.com/ossobv/gocollect/gocollect-client/signal"
+)
+
+func TestDaemon_reload_StartupKeys(t *testing.T) {
+	var buf bytes.Buffer
+	saved := log.Log
+	log.Log = golog.New(&buf, "", 0)
+	t.Cleanup(func() { log.Log = saved })
+
+	options, socket := writeDoctorConfig(t, "http://127.0.0.1:1", "")
+	filename := options["config"].String
+	conf, e := parseConfig(filename, options)
+	if e != nil {
+		t.Fatal(e)
+	}
+	collectRunner, problems := createCollectRunner(options, conf)
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	d := newDaemon(&collectRunner, options, conf)
+
+	// Nothing changed.
+	resp := d.reload()
+	if !resp.OK || strings.Contains(resp.Message, "restart") {
+		t.Errorf("unexpected reload response: %+v", resp)
+	}
+
+	// The socket and the listener stay as they were, so we warn.
+	contents, _ := ioutil.ReadFile(filename)
+	contents = bytes.Replace(
+		contents, []byte(socket), []byte(socket+".new"), 1)
+	contents = append(contents, "metrics_listen = 127.0.0.1:9100\n"...)
+	ioutil.WriteFile(filename, contents, 0644)
+	buf.Reset()
+	resp = d.reload()
+	warning := "restart gocollect to apply control_socket, metrics_listen"
+	if !resp.OK || !strings.HasSuffix(resp.Message, "; "+warning) {
+		t.Errorf("unexpected reload response: %+v", resp)
+	}
+	if !strings.Contains(buf.String(), "reload: "+warning+"\n") {
+		t.Errorf("expected warning in log, got:\n%s", buf.String())
+	}
+}
+
+func TestDaemon_loop_OneShotExitCode(t *testing.T) {
+	var buf bytes.Buffer
+	saved := log.Log
+	log.Log = golog.New(&buf, "", 0)
+	t.Cleanup(func() { log.Log = saved })
+
+	// Registering fails: nothing listens there.
+	options, _ := writeDoctorConfig(t, "http://127.0.0.1:1", "")
+	conf, e := parseConfig(options["config"].String, options)
+	if e != nil {
+		t.Fatal(e)
+	}
+	newTestDaemon := func() *daemon {
+		collectRunner, problems := createCollectRunner(options, conf)
+		if len(problems) != 0 {
+			t.Fatalf("unexpected problems: %v", problems)
+		}
+		dir := filepath.Dir(options["config"].String)
+		collectRunner.RegidFilename = filepath.Join(dir, "regid")
+		collectRunner.StateFilename = filepath.Join(dir, "state.json")
+		collectRunner.OutboxPath = filepath.Join(dir, "outbox")
+		return newDaemon(&collectRunner, options, conf)
+	}
+
+	// A failed run returns, instead of exiting.
+	d := newTestDaemon()
+	if code := d.loop(conf, signal.Handler{}, true); code != 1 {
+		t.Errorf("failed run: expected exit code 1, got %d", code)
+	}
+
+	// So does a shutdown.
+	d = newTestDaemon()
+	close(d.stop)
+	if code := d.loop(conf, signal.Handler{}, true); code != 1 {
+		t.Errorf("shutdown: expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(buf.String(), "Shutdown complete\n") {
+		t.Errorf("expected shutdown in log, got:\n%s", buf.String())
+	}
+}
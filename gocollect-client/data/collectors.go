@@ -3,15 +3,36 @@
 package data
 
 import (
+	"context"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/ossobv/gocollect/gocollect-client/log"
 )
 
 // CollectorRun is the function signature to use as the Run function in
-// the Collector struct.
-type CollectorRun func(key string, runargs string) Collected
+// the Collector struct. It gets the RunArgs and the Settings of the
+// collector. Collectors should log through log.FromContext(ctx), as
+// they may run concurrently.
+type CollectorRun func(ctx context.Context, key string, runargs string,
+	settings Settings) Collected
+
+// Settings holds the extra arguments and environment variables
+// ("NAME=VALUE") for a collector, from the config, and how much of its
+// stderr may be logged.
+type Settings struct {
+	Args        []string
+	Env         []string
+	StderrLimit LogLimit
+}
+
+// LogLimit rate limits logging: a burst of Burst lines, and then one
+// line per Interval. The zero LogLimit logs everything.
+type LogLimit struct {
+	Burst    int
+	Interval time.Duration
+}
 
 // Collector holds instructions how to call a collector.
 type Collector struct {
@@ -19,8 +40,19 @@ type Collector struct {
 	Run CollectorRun
 	// Optional arguments to callable.
 	RunArgs string
+	// For scripts: the scripts with the same name in earlier
+	// collectors paths, which this one overrides.
+	Shadowed []string
 	// Whether this collector is enabled.
 	IsEnabled bool
+	// Why the collector is disabled, if it cannot be enabled from the
+	// config (like a script that is not executable), or if the config
+	// disabled it.
+	Reason string
+
+	// Extra arguments and environment from the config. The builtin
+	// collectors have no use for them.
+	Settings
 }
 
 // Collectors holds a key/value map of strings/Collector where key is
@@ -50,14 +82,20 @@ func MergeCollectors(c1 *Collectors, c2 *Collectors) *Collectors {
 }
 
 // Run runs/executes the collector and returns the data.
-func (c *Collectors) Run(key string) Collected {
+func (c *Collectors) Run(ctx context.Context, key string) Collected {
 	if collector, exists := (*c)[key]; exists {
 		if collector.IsEnabled {
-			return collector.Run(key, collector.RunArgs)
+			return collector.Run(
+				ctx, key, collector.RunArgs, collector.Settings)
+		}
+		if collector.Reason != "" {
+			log.FromContext(ctx).Printf(
+				"collector[%s]: is disabled: %s", key, collector.Reason)
+		} else {
+			log.FromContext(ctx).Printf("collector[%s]: is disabled", key)
 		}
-		log.Log.Printf("collector[%s]: is disabled", key)
 	} else {
-		log.Log.Printf("collector[%s]: does not exist", key)
+		log.FromContext(ctx).Printf("collector[%s]: does not exist", key)
 	}
 	return EmptyCollected()
 }
@@ -70,10 +108,16 @@ func (c *Collectors) GetRunnable() (keys []string) {
 			keys = append(keys, key)
 		}
 	}
-	sort.Sort(byKeyName(keys))
+	SortKeys(keys)
 	return keys
 }
 
+// SortKeys sorts collector keys in run order: sorted, but core.* first,
+// then sys.* and os.*.
+func SortKeys(keys []string) {
+	sort.Sort(byKeyName(keys))
+}
+
 // Sorting functions below: sort core.* before sys.*, etc..
 // This way we'll get "core.id" first. This should always be accepted.
 // So if it isn't, we can abort the entire run.
@@ -0,0 +1,33 @@
+// Package data (gocollect) holds the collected data to make it ready
+// for submittal.
+package data
+
+import (
+	"context"
+)
+
+// RunReport holds details about a collector run that are not part of
+// the collected data. The runner attaches one to the context, the
+// collector fills it in.
+type RunReport struct {
+	// Stderr holds the (first) lines the collector wrote to stderr.
+	Stderr []string
+	// Failure is the reason the collector failed (exit, signal,
+	// decode, timeout or exec), aborted if it was killed because we
+	// are shutting down, or empty if it did not fail.
+	Failure string
+}
+
+type reportKey struct{}
+
+// NewReportContext returns a copy of the context that carries the
+// report.
+func NewReportContext(ctx context.Context, report *RunReport) context.Context {
+	return context.WithValue(ctx, reportKey{}, report)
+}
+
+// ReportFromContext returns the report carried by the context, or nil.
+func ReportFromContext(ctx context.Context) *RunReport {
+	report, _ := ctx.Value(reportKey{}).(*RunReport)
+	return report
+}
@@ -3,18 +3,19 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	getopt "github.com/ossobv/go-getopt"
-	"io/ioutil"
 	golog "log"
 	"log/syslog"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/ossobv/gocollect/gocollect-client/config"
+	"github.com/ossobv/gocollect/gocollect-client/lockfile"
 	"github.com/ossobv/gocollect/gocollect-client/log"
-	"github.com/ossobv/gocollect/gocollect-client/runner"
 	"github.com/ossobv/gocollect/gocollect-client/runnerinst"
 	"github.com/ossobv/gocollect/gocollect-client/signal"
 
@@ -26,13 +27,11 @@ import (
 // language.)
 var versionStr string
 
-// The configfile consists of a series of key=value pairs where key is
-// not unique. However, for keys where only a single value makes sense,
-// only the *last* value found will be used.
-type configMap map[string]([]string)
-
 const defaultConfigFile = "/etc/gocollect.conf"
 const defaultRegidFilename = "/var/lib/gocollect/core.id.regid"
+const defaultStateFilename = "/var/lib/gocollect/state.json"
+const controlTimeout = 15 * time.Minute
+const doctorTimeout = 10 * time.Second
 
 func printVersionAndExit() {
 	fmt.Printf(
@@ -50,184 +49,51 @@ func printVersionAndExit() {
 	os.Exit(0)
 }
 
-func printErrorAndExit(errstr string, optionDefinition getopt.Options) {
+func printErrorAndExit(
+	progName string, errstr string, optionDefinition getopt.Options) {
+
 	fmt.Fprintf(
 		os.Stderr, "%s: %s\n\n%s\nSee --help for more info.\n",
-		filepath.Base(os.Args[0]), errstr,
+		progName, errstr,
 		strings.TrimSpace(optionDefinition.Usage()))
 	os.Exit(1)
 }
 
-func getOptionDefinition() getopt.Options {
-	return getopt.Options{
-		// ..4...8......16......24......32......40......48......56......64
-		Description: ("GoCollect collects data through a series of scripts " +
-			"and publishes it to\na central server."),
-		Definitions: getopt.Definitions{
-			{OptionDefinition: "config|c",
-				Description:  "config file",
-				Flags:        (getopt.Optional | getopt.ExampleIsDefault),
-				DefaultValue: defaultConfigFile},
-			{OptionDefinition: "one-shot|s",
-				Description:  "run once and exit",
-				Flags:        getopt.Flag,
-				DefaultValue: false},
-			{OptionDefinition: "test-key|k",
-				Description:  "print single collector output on stdout",
-				Flags:        getopt.Optional,
-				DefaultValue: ""},
-			{OptionDefinition: "without-root",
-				Description:  "allow run as non-privileged user",
-				Flags:        getopt.Flag,
-				DefaultValue: false},
-			{OptionDefinition: "version|V",
-				Description:  "print version",
-				Flags:        getopt.Flag,
-				DefaultValue: false},
-		},
+// acquireLockOrExit makes sure we are the only gocollect running. With
+// --delegate, we ask the one that is running to do the run instead. If
+// the lock file cannot be used at all, we warn and run without it.
+func acquireLockOrExit(
+	options map[string]getopt.OptionValue,
+	conf *config.Config) *lockfile.Lock {
+
+	cp := configParser{conf: conf}
+	path := cp.getString("lock_file")
+	if path == "" {
+		return nil
 	}
-}
-
-func parseArgsOrExit() (options map[string]getopt.OptionValue) {
-	optionDefinition := getOptionDefinition()
-	options, arguments, passThrough, e := optionDefinition.ParseCommandLine()
-
-	// Check and print help before checking option syntax.
-	if _, ok := options["help"]; ok {
-		fmt.Print(optionDefinition.Help())
-		os.Exit(0)
-	} else if e != nil {
-		printErrorAndExit(e.Error(), optionDefinition)
-	} else if len(arguments) > 0 {
-		printErrorAndExit("too many arguments", optionDefinition)
-	} else if val, ok := options["version"]; ok && val.Bool {
-		printVersionAndExit()
-	} else if len(passThrough) != 0 {
-		errstr := fmt.Sprintf("excess args after -- %#v", passThrough)
-		printErrorAndExit(errstr, optionDefinition)
-	}
-
-	// debugPrintOptions(options)
-	return options
-}
 
-func debugPrintOptions(options map[string]getopt.OptionValue) {
-	for key, value := range options {
-		fmt.Printf("%s = %v\n", key, value)
-	}
-}
-
-func parseConfigOrExit(filename string) (config configMap) {
-	data, e := ioutil.ReadFile(filename)
-	if e != nil {
-		fmt.Fprintf(
-			os.Stderr, "%s: %s\n\nSee --help for more info.\n",
-			filepath.Base(os.Args[0]), e.Error())
-		os.Exit(1)
-	}
-
-	config = configMap{}
-	config["config_path"] = []string{filepath.Dir(filename)}
-	parseConfigWithIncludes(&config, filename, data, 0)
-	// debugPrintConfig(config)
-	return config
-}
-
-func parseConfigWithIncludes(config *configMap, filename string,
-	data []byte, depth int) {
-	if depth >= 10 {
-		fmt.Fprintf(
-			os.Stderr, "%s: Ridiculous include depth in %s config file!\n",
-			filepath.Base(os.Args[0]), filename)
-		os.Exit(1)
-	}
-
-	for i, line := range bytes.Split(data, []byte{'\n'}) {
-		line = bytes.TrimSpace(line)
-		if len(line) > 0 && line[0] != '#' {
-			args := bytes.SplitN(line, []byte{'='}, 2)
-			if len(args) == 2 {
-				key := string(bytes.TrimSpace(args[0]))
-				value := string(bytes.TrimSpace(args[1]))
-
-				if key == "include" {
-					newData, e := ioutil.ReadFile(value)
-					if e == nil {
-						parseConfigWithIncludes(config, value, newData,
-							depth+1)
-					}
-				} else {
-					(*config)[key] = append((*config)[key], value)
-				}
-
-			} else {
+	lock, e := lockfile.Acquire(path)
+	if held, ok := e.(*lockfile.HeldError); ok {
+		if options["delegate"].Bool && held.PID != 0 {
+			if e = syscall.Kill(held.PID, syscall.SIGUSR1); e == nil {
 				fmt.Fprintf(
-					os.Stderr, "%s:%d: missing equals sign\n", filename, i)
+					os.Stderr, "%s: asked the running gocollect (pid %d) "+
+						"to run all collectors\n",
+					filepath.Base(os.Args[0]), held.PID)
+				os.Exit(0)
 			}
 		}
-	}
-}
-
-func debugPrintConfig(config configMap) {
-	for key := range config {
-		for _, val := range config[key] {
-			fmt.Printf("%s = %s\n", key, val)
-		}
-	}
-}
-
-func checkOptionsOrExit(options map[string]getopt.OptionValue) {
-	// Check that user is root.
-	if os.Getuid() != 0 && !options["without-root"].Bool {
-		if _, ok := options["test-key"]; ok {
-			fmt.Fprintf(
-				os.Stderr,
-				("%s: Beware, running the collector as non-superuser may " +
-					"yield incomplete data.\n"),
-				filepath.Base(os.Args[0]))
-			// don't exit
-		} else {
-			fmt.Fprintf(
-				os.Stderr,
-				("%s: Running gocollect as non-privileged user may " +
-					"cause several\n" +
-					"collectors to return too little info. Pass " +
-					"--without-root to bypass this check.\n"),
-				filepath.Base(os.Args[0]))
-			os.Exit(1)
-		}
-	}
-
-	// Only allow --test-key with --one-shot.
-	if _, ok := options["test-key"]; ok && !options["one-shot"].Bool {
 		fmt.Fprintf(
-			os.Stderr,
-			"%s: --test-key only works together with --one-shot.\n",
-			filepath.Base(os.Args[0]))
+			os.Stderr, "%s: gocollect is already running (%s)\n",
+			filepath.Base(os.Args[0]), held.Error())
 		os.Exit(1)
+	} else if e != nil {
+		// Not a reason to refuse to run: a --without-root run cannot
+		// write the default lock file, for one.
+		log.Log.Printf("lock: %s; running without the lock", e)
+		return nil
 	}
-}
-
-func createCollectRunner(
-	options map[string]getopt.OptionValue, config configMap) (
-	ret runner.Runner) {
-
-	// Take options and config and extract relevant values.
-	if keys, ok := config["api_key"]; ok {
-		ret.APIKey = keys[len(keys)-1] // must have len>=1
-	}
-	if urls, ok := config["register_url"]; ok {
-		ret.RegisterURL = urls[len(urls)-1] // must have len>=1
-	}
-	if urls, ok := config["push_url"]; ok {
-		ret.PushURL = urls[len(urls)-1] // must have len>=1
-	}
-	ret.ConfigPathBase = config["config_path"][0]
-	ret.CollectorsPaths = config["collectors_path"]
-	ret.RegidFilename = defaultRegidFilename
-	ret.GoCollectVersion = versionStr
-
-	return ret
+	return lock
 }
 
 func setupLogger(oneShot bool) *golog.Logger {
@@ -251,71 +117,100 @@ func setupLogger(oneShot bool) *golog.Logger {
 }
 
 func main() {
+	os.Exit(gocollect())
+}
+
+// gocollect is main, but it returns the exit code, so the deferred
+// cleanup (like releasing the lock file) is done before we exit.
+func gocollect() (exitCode int) {
 	// Check basic arguments.
-	options := parseArgsOrExit()
-	oneShot := options["one-shot"].Bool
-	// Check config file.
-	config := parseConfigOrExit(options["config"].String)
+	name, options, arguments := parseCommandLineOrExit()
+	oneShot := name != "daemon"
+	// Check config file. (Before parsing it, so we can report all
+	// problems at once.)
+	if name == "check-config" && !options["print"].Bool {
+		checkConfigAndExit(options)
+	}
+	if name == "doctor" {
+		doctorAndExit(options)
+	}
+	conf := parseConfigOrExit(options)
+	switch name {
+	case "check-config":
+		// Show where the config values come from.
+		printConfigAndExit(options, conf)
+	case "ctl":
+		// Talk to the running daemon.
+		controlClientAndExit(conf, arguments)
+	case "import-push":
+		// Push a bundle made by "gocollect export" on another host.
+		importPushAndExit(options, conf, arguments[0])
+	case "list":
+		listCollectorsAndExit(options, conf)
+	case "status":
+		// Show the results of the last run.
+		printStatusAndExit(options, conf)
+	}
 	// Passed options scan.
-	checkOptionsOrExit(options)
+	checkOptionsOrExit(name, options)
 	// Extract arguments, creating a CollectRunner.
-	collectRunner := createCollectRunner(options, config)
+	collectRunner := createCollectRunnerOrExit(options, conf)
 	runnerinst.SetRunner(&collectRunner)
 	defer runnerinst.SetRunner(nil)
 	// Create and set global logger.
 	log.Log = setupLogger(oneShot)
 	// Use signals to sleep in the main thread.
 	sigHandler := signal.NewAlarmHupUsr1()
+	// Make sure we're the only one running. (After setting up the
+	// signals: a --delegate run may send us a SIGUSR1.) Collect, dry
+	// runs and exports do not push, so they may always run.
+	if name != "collect" && name != "export" && !isDryRun(options) {
+		if lock := acquireLockOrExit(options, conf); lock != nil {
+			defer lock.Release()
+		}
+	}
+
+	// Remember the daemon state for the control socket. Shut down
+	// gracefully on TERM/INT. The one-off commands have nothing to
+	// finish; they abort right away.
+	d := newDaemon(&collectRunner, options, conf)
+	cp := configParser{conf: conf}
+	shutdownGrace := cp.getDuration("shutdown_grace")
+	exitOnConfigErrors(cp.problems)
+	oneOff := (name == "collect" || name == "register" ||
+		name == "export" || isDryRun(options))
+	if oneOff {
+		go d.abortOnSignal(signal.NewTermInt().Chan)
+	} else {
+		go d.shutdownOnSignal(signal.NewTermInt().Chan, shutdownGrace)
+	}
 
 	// Do the work in /tmp. In case sub applications want to write cache
-	// files or similar.
+	// files or similar. (The dry run output dir and the export file are
+	// relative to where we were.)
+	outputDir := ""
+	if value, ok := options["output-dir"]; ok {
+		outputDir, _ = filepath.Abs(value.String)
+	}
+	exportFile := ""
+	if name == "export" && len(arguments) == 1 && arguments[0] != "-" {
+		exportFile, _ = filepath.Abs(arguments[0])
+	}
 	os.Chdir("/tmp")
 
-	// Single test key.
-	if testKey, ok := options["test-key"]; ok {
-		result := collectRunner.Get(testKey.String)
-		if result == "" {
-			os.Exit(1)
-		}
-		fmt.Print(result)
-		return
+	switch {
+	case name == "collect":
+		collectAndExit(&collectRunner, arguments)
+	case name == "register":
+		return register(&collectRunner)
+	case name == "export":
+		exportAndExit(&collectRunner, exportFile)
+	case isDryRun(options):
+		// Dry run: everything but the pushing.
+		dryRunAndExit(&collectRunner, outputDir)
 	}
 
 	// Do complete run.
 	os.Stdout.Close()
-	var interval int
-	last_success := true
-	for {
-		ret := collectRunner.Run()
-		if oneShot {
-			if !ret {
-				log.Log.Fatal("CollectRunner.Run() returned false")
-			}
-			return
-		}
-
-		if ret {
-			// All good, run again in 4 hours
-			interval = 4 * 3600
-			last_success = true
-		} else if last_success {
-			// Retry in 5 minutes if this is the first run
-			interval = 300
-			last_success = false
-		} else {
-			// Keep retrying in larger intervals
-			interval *= 2
-			if interval > (4 * 3600) {
-				// Until we're at max
-				interval = 4 * 3600
-			}
-		}
-
-		signal.Alarm(interval)
-		sig := <-sigHandler.Chan // wait for SIGALRM or SIGHUP or SIGUSR1
-		if sig.String() != "alarm clock" {
-			signal.Alarm(0)
-			log.Log.Printf("Got %s to wake up early", sig.String())
-		}
-	}
+	return d.loop(conf, sigHandler, oneShot)
 }
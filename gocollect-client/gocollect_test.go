@@ -5,6 +5,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -19,14 +20,14 @@ func assertEqual(t *testing.T, a interface{}, b interface{}, message string) {
 }
 
 func TestParseArgsOrExit_NoOptions(t *testing.T) {
-	args := parseArgsOrExit()
+	args, _ := parseArgsOrExit()
 	assertEqual(t, args["one-shot"].Bool, false, "")
 	assertEqual(t, args["config"].String, "/etc/gocollect.conf", "")
 }
 
 func TestParseArgsOrExit_ShortOpts(t *testing.T) {
 	os.Args = []string{"prog", "-s", "-c", "/dev/null"}
-	args := parseArgsOrExit()
+	args, _ := parseArgsOrExit()
 	assertEqual(t, args["one-shot"].Bool, true, "")
 	assertEqual(t, args["config"].String, "/dev/null", "")
 }
@@ -34,7 +35,93 @@ func TestParseArgsOrExit_ShortOpts(t *testing.T) {
 func TestParseArgsOrExit_VeryShortOpts(t *testing.T) {
 	// https://github.com/kesselborn/go-getopt/pull/1
 	os.Args = []string{"prog", "-sc", "/foo/bar"}
-	args := parseArgsOrExit()
+	args, _ := parseArgsOrExit()
 	assertEqual(t, args["one-shot"].Bool, true, "")
 	assertEqual(t, args["config"].String, "/foo/bar", "")
 }
+
+func TestParseCommandLineOrExit_Command(t *testing.T) {
+	os.Args = []string{"prog", "-c", "/foo/bar", "collect", "app.a", "app.b"}
+	name, options, arguments := parseCommandLineOrExit()
+	assertEqual(t, name, "collect", "")
+	assertEqual(t, options["config"].String, "/foo/bar", "")
+	assertEqual(t, strings.Join(arguments, ","), "app.a,app.b", "")
+}
+
+func TestParseCommandLineOrExit_OldOptions(t *testing.T) {
+	os.Args = []string{"prog", "-sk", "app.a"}
+	name, _, arguments := parseCommandLineOrExit()
+	assertEqual(t, name, "collect", "")
+	assertEqual(t, strings.Join(arguments, ","), "app.a", "")
+
+	os.Args = []string{"prog", "--dry-run", "--output-dir", "run"}
+	name, options, _ := parseCommandLineOrExit()
+	assertEqual(t, name, "run", "")
+	assertEqual(t, options["output-dir"].String, "run", "")
+}
+
+func TestFindCommandArg(t *testing.T) {
+	type inout struct {
+		in  string
+		out int
+	}
+	list := []inout{
+		{"run", 0},
+		{"-c FILE run", 2},
+		{"-cFILE run", 1},
+		{"-sc FILE run", 2},
+		{"--config FILE run", 2},
+		{"--config=run", -1},
+		{"--config=FILE run", 1},
+		{"-c run", -1}, // the config file is named run
+		{"--dry-run --output-dir run", -1},
+		{"-- run", -1},
+		{"-s", -1},
+		{"nosuchcommand", -1},
+		{"", -1},
+	}
+	for i, item := range list {
+		actual := findCommandArg(strings.Fields(item.in))
+		if actual != item.out {
+			t.Errorf("#%d: findCommandArg(%q) returned %d, expected %d",
+				i, item.in, actual, item.out)
+		}
+	}
+}
+
+func TestLegacyCommand(t *testing.T) {
+	type inout struct {
+		in   string
+		name string
+		args string
+	}
+	list := []inout{
+		{"", "daemon", ""},
+		{"-s", "run", ""},
+		{"--dry-run", "run", ""},
+		{"--output-dir /tmp/x", "run", ""},
+		{"-sk app.a", "collect", "app.a"},
+		{"--check-config", "check-config", ""},
+		{"--print-config", "check-config", ""},
+		{"--list --json", "list", ""},
+		{"--status", "status", ""},
+	}
+	for i, item := range list {
+		os.Args = append([]string{"prog"}, strings.Fields(item.in)...)
+		options, _ := parseArgsOrExit()
+		name, arguments := legacyCommand(options)
+		if name != item.name || strings.Join(arguments, " ") != item.args {
+			t.Errorf("#%d: legacyCommand(%q) returned %s %v, expected %s %s",
+				i, item.in, name, arguments, item.name, item.args)
+		}
+		if item.in == "--print-config" && !options["print"].Bool {
+			t.Errorf("#%d: --print-config did not set print", i)
+		}
+	}
+}
+
+func TestParseCommandLineOrExit_KeepsArgs(t *testing.T) {
+	os.Args = []string{"prog", "run", "--dry-run"}
+	parseCommandLineOrExit()
+	assertEqual(t, strings.Join(os.Args, " "), "prog run --dry-run", "")
+}
@@ -0,0 +1,79 @@
+// Package lockfile (gocollect) makes sure only one GoCollect runs at a
+// time. The lock file is locked with flock(2) and holds the PID of the
+// holder, so it doubles as pidfile.
+package lockfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Lock is a held lock file.
+type Lock struct {
+	file *os.File
+}
+
+// HeldError is returned by Acquire if someone else holds the lock.
+type HeldError struct {
+	Path string
+	// PID of the holder, or 0 if unknown.
+	PID int
+}
+
+func (e *HeldError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s: locked by another process", e.Path)
+	}
+	return fmt.Sprintf("%s: locked by pid %d", e.Path, e.PID)
+}
+
+// Acquire takes the lock without waiting, and writes our PID into the
+// file. If the lock is held, a *HeldError is returned.
+func Acquire(path string) (*Lock, error) {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		pid, _ := ReadPID(path)
+		return nil, &HeldError{Path: path, PID: pid}
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt(
+			[]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file: file}, nil
+}
+
+// Release empties the file and releases the lock. The file itself is
+// left alone: removing it would let two processes lock different files.
+func (l *Lock) Release() {
+	l.file.Truncate(0)
+	l.file.Close()
+}
+
+// ReadPID returns the PID stored in the lock file.
+func ReadPID(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
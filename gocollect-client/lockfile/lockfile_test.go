@@ -0,0 +1,39 @@
+package lockfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gocollect.lock")
+
+	lock, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second lock conflicts, even from the same process.
+	_, err = Acquire(path)
+	held, ok := err.(*HeldError)
+	if !ok {
+		t.Fatalf("expected HeldError, got %v", err)
+	}
+	if held.PID != os.Getpid() {
+		t.Errorf("expected pid %d, got %d", os.Getpid(), held.PID)
+	}
+
+	lock.Release()
+	lock, err = Acquire(path)
+	if err != nil {
+		t.Fatalf("after release: %s", err)
+	}
+	lock.Release()
+}
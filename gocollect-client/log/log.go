@@ -2,8 +2,27 @@
 package log
 
 import (
+	"context"
 	golog "log"
 )
 
 // Log references a valid logger here. The application should set this ASAP.
 var Log *golog.Logger
+
+type contextKey struct{}
+
+// NewContext returns a copy of the context that carries the logger.
+// Use it to hand a different logger to code that runs concurrently,
+// like the collectors.
+func NewContext(ctx context.Context, logger *golog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by the context, or Log if
+// there is none.
+func FromContext(ctx context.Context) *golog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*golog.Logger); ok {
+		return logger
+	}
+	return Log
+}
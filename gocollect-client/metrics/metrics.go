@@ -0,0 +1,278 @@
+// Package metrics (gocollect) exports counters and gauges about the
+// GoCollect daemon itself, in the Prometheus text exposition format.
+//
+// The metrics are either served over HTTP (Serve) or written to a file
+// for the node_exporter textfile collector (WriteTextfile).
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ossobv/gocollect/gocollect-client/log"
+)
+
+// Family is a metric with zero or more labels. Each combination of
+// label values holds its own value.
+type Family struct {
+	name       string
+	help       string
+	kind       string // counter or gauge
+	labelNames []string
+	values     map[string]float64 // by rendered labels
+	valueFunc  func() (float64, bool)
+	registry   *Registry
+}
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*Family
+}
+
+// NewRegistry returns an empty registry. The package functions use
+// the default registry; tests can use their own.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*Family)}
+}
+
+var defaultRegistry = NewRegistry()
+
+// NewCounter registers a counter in the default registry.
+func NewCounter(name string, help string, labelNames ...string) *Family {
+	return defaultRegistry.NewCounter(name, help, labelNames...)
+}
+
+// NewGauge registers a gauge in the default registry.
+func NewGauge(name string, help string, labelNames ...string) *Family {
+	return defaultRegistry.NewGauge(name, help, labelNames...)
+}
+
+// NewGaugeFunc registers a gauge function in the default registry.
+func NewGaugeFunc(
+	name string, help string, f func() (float64, bool)) *Family {
+
+	return defaultRegistry.NewGaugeFunc(name, help, f)
+}
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(
+	name string, help string, labelNames ...string) *Family {
+
+	return r.register(&Family{
+		name: name, help: help, kind: "counter", labelNames: labelNames})
+}
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(
+	name string, help string, labelNames ...string) *Family {
+
+	return r.register(&Family{
+		name: name, help: help, kind: "gauge", labelNames: labelNames})
+}
+
+// NewGaugeFunc registers a gauge without labels that is evaluated when
+// the metrics are written. If f returns false, the gauge is left out.
+func (r *Registry) NewGaugeFunc(
+	name string, help string, f func() (float64, bool)) *Family {
+
+	return r.register(&Family{
+		name: name, help: help, kind: "gauge", valueFunc: f})
+}
+
+func (r *Registry) register(f *Family) *Family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.families[f.name]; exists {
+		panic("metrics: duplicate metric " + f.name)
+	}
+	f.values = make(map[string]float64)
+	f.registry = r
+	r.families[f.name] = f
+	return f
+}
+
+// Add adds v to the value with these label values.
+func (f *Family) Add(v float64, labelValues ...string) {
+	key := f.labels(labelValues)
+	f.registry.mutex.Lock()
+	f.values[key] += v
+	f.registry.mutex.Unlock()
+}
+
+// Set sets the value with these label values.
+func (f *Family) Set(v float64, labelValues ...string) {
+	key := f.labels(labelValues)
+	f.registry.mutex.Lock()
+	f.values[key] = v
+	f.registry.mutex.Unlock()
+}
+
+// Get returns the value with these label values.
+func (f *Family) Get(labelValues ...string) float64 {
+	key := f.labels(labelValues)
+	f.registry.mutex.Lock()
+	defer f.registry.mutex.Unlock()
+	return f.values[key]
+}
+
+// labels renders the label values as name="value",... (without the
+// braces).
+func (f *Family) labels(labelValues []string) string {
+	if len(labelValues) != len(f.labelNames) {
+		panic("metrics: wrong number of labels for " + f.name)
+	}
+	pairs := make([]string, len(labelValues))
+	for i, value := range labelValues {
+		pairs[i] = f.labelNames[i] + "=" + quoteLabelValue(value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func quoteLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return `"` + value + `"`
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Write writes all metrics in the default registry.
+func Write(w io.Writer) error {
+	return defaultRegistry.Write(w)
+}
+
+// Write writes all metrics in the Prometheus text format, sorted by
+// name and labels.
+func (r *Registry) Write(w io.Writer) error {
+	// Take a snapshot, so the gauge functions run without the lock.
+	r.mutex.Lock()
+	snapshot := make([]Family, 0, len(r.families))
+	for _, f := range r.families {
+		copied := *f
+		copied.values = make(map[string]float64, len(f.values))
+		for key, v := range f.values {
+			copied.values[key] = v
+		}
+		snapshot = append(snapshot, copied)
+	}
+	r.mutex.Unlock()
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].name < snapshot[j].name
+	})
+
+	var buf bytes.Buffer
+	for _, f := range snapshot {
+		if f.valueFunc != nil {
+			v, ok := f.valueFunc()
+			if !ok {
+				continue
+			}
+			f.values[""] = v
+		}
+
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.kind)
+		keys := make([]string, 0, len(f.values))
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key == "" {
+				fmt.Fprintf(&buf, "%s %s\n", f.name, formatValue(f.values[key]))
+			} else {
+				fmt.Fprintf(&buf, "%s{%s} %s\n",
+					f.name, key, formatValue(f.values[key]))
+			}
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteTextfile atomically writes the metrics to filename, for the
+// node_exporter textfile collector.
+func WriteTextfile(filename string) error {
+	var buf bytes.Buffer
+	Write(&buf)
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Serve serves the metrics on http://addr/metrics in the background.
+func Serve(addr string) (io.Closer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+	closed := make(chan struct{})
+	go func() {
+		err := http.Serve(listener, mux)
+		select {
+		case <-closed:
+		default:
+			log.Log.Printf("metrics: stopped serving %s: %s", addr, err)
+		}
+	}()
+	return closerFunc(func() error {
+		close(closed)
+		return listener.Close()
+	}), nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	runs := r.NewCounter("test_runs_total", "Number of runs.", "result")
+	runs.Add(1, "ok")
+	runs.Add(2, "ok")
+	runs.Add(1, `say "fail"`)
+	r.NewGauge("test_backoff_seconds", "Retry backoff.").Set(300)
+	r.NewGaugeFunc("test_absent", "Left out.", func() (float64, bool) {
+		return 0, false
+	})
+	r.NewGaugeFunc("test_func", "Evaluated.", func() (float64, bool) {
+		return 0.5, true
+	})
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	expected := `# HELP test_backoff_seconds Retry backoff.
+# TYPE test_backoff_seconds gauge
+test_backoff_seconds 300
+# HELP test_func Evaluated.
+# TYPE test_func gauge
+test_func 0.5
+# HELP test_runs_total Number of runs.
+# TYPE test_runs_total counter
+test_runs_total{result="ok"} 3
+test_runs_total{result="say \"fail\""} 1
+`
+	if buf.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
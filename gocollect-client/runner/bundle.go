@@ -0,0 +1,240 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+	"github.com/ossobv/gocollect/gocollect-client/log"
+)
+
+// A bundle is a tar archive with the collected data of a host that
+// cannot reach the server. It holds, in order:
+//   - manifest.json: a bundleManifestInfo, with the checksums of the data;
+//   - manifest.sha256: the checksum of the manifest;
+//   - data/KEY.json: the data of every collector, core.id first.
+const (
+	bundleVersion      = 1
+	bundleManifest     = "manifest.json"
+	bundleManifestHash = "manifest.sha256"
+	bundleDataDir      = "data/"
+)
+
+// The largest entry we read from a bundle. Collector data is usually
+// small; this only protects against broken or malicious bundles.
+var maxBundleEntrySize int64 = 64 << 20
+
+type bundleManifestInfo struct {
+	Version   int       `json:"version"`
+	Created   time.Time `json:"created"`
+	GoCollect string    `json:"gocollect"`
+	// The host, from the core.id data. The regid is empty if the host
+	// was not registered yet.
+	FQDN  string       `json:"fqdn"`
+	Regid string       `json:"regid,omitempty"`
+	Files []bundleFile `json:"files"`
+}
+
+type bundleFile struct {
+	Collector string `json:"collector"`
+	Name      string `json:"name"`
+	Size      int    `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// hasCoreID returns true if the first file holds the core.id data. We
+// need that for the push URLs.
+func (m *bundleManifestInfo) hasCoreID() bool {
+	return len(m.Files) != 0 && m.Files[0].Collector == "core.id"
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Export runs all enabled collectors like DryRun, and writes their data
+// to w as a bundle, for ImportPush on a host that can reach the server.
+func (r *Runner) Export(w io.Writer) error {
+	manifest := bundleManifestInfo{
+		Version: bundleVersion, Created: time.Now().UTC(),
+		GoCollect: r.GoCollectVersion}
+	contents := make(map[string][]byte)
+
+	err := r.DryRun(func(collectorKey string, _ string, data []byte) error {
+		if collectorKey == "core.id" {
+			var decoded map[string]interface{}
+			json.Unmarshal(data, &decoded)
+			manifest.FQDN, _ = decoded["fqdn"].(string)
+			manifest.Regid, _ = decoded["regid"].(string)
+		}
+		name := bundleDataDir + collectorKey + ".json"
+		manifest.Files = append(manifest.Files, bundleFile{
+			Collector: collectorKey, Name: name, Size: len(data),
+			SHA256: sha256Hex(data)})
+		contents[name] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if !manifest.hasCoreID() {
+		return errors.New("no core.id data")
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+
+	tw := tar.NewWriter(w)
+	add := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name: name, Mode: 0644, Size: int64(len(data)),
+			ModTime: manifest.Created, Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		return err
+	}
+	if err = add(bundleManifest, encoded); err != nil {
+		return err
+	}
+	hash := sha256Hex(encoded) + "  " + bundleManifest + "\n"
+	if err = add(bundleManifestHash, []byte(hash)); err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		if err = add(file.Name, contents[file.Name]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// readBundle reads the bundle and checks the checksums. Entries that
+// are too large, duplicate or not in the manifest are refused.
+func readBundle(rd io.Reader) (
+	manifest bundleManifestInfo, contents map[string][]byte, err error) {
+
+	contents = make(map[string][]byte)
+	tr := tar.NewReader(rd)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, nil, err
+		}
+		if _, ok := contents[header.Name]; ok {
+			return manifest, nil, errors.New(header.Name + ": duplicate")
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(tr, maxBundleEntrySize+1))
+		if err != nil {
+			return manifest, nil, err
+		} else if int64(len(data)) > maxBundleEntrySize {
+			return manifest, nil, errors.New(header.Name + ": too large")
+		}
+		contents[header.Name] = data
+	}
+
+	encoded, ok := contents[bundleManifest]
+	if !ok {
+		return manifest, nil, errors.New("not a bundle: no " + bundleManifest)
+	}
+	hash := sha256Hex(encoded) + "  " + bundleManifest + "\n"
+	if string(contents[bundleManifestHash]) != hash {
+		return manifest, nil, errors.New(bundleManifest + ": bad checksum")
+	}
+	if err = json.Unmarshal(encoded, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("%s: %s", bundleManifest, err)
+	} else if manifest.Version != bundleVersion {
+		return manifest, nil, fmt.Errorf(
+			"%s: unsupported version %d", bundleManifest, manifest.Version)
+	}
+	if !manifest.hasCoreID() {
+		return manifest, nil, errors.New(
+			bundleManifest + ": no core.id data")
+	}
+	known := map[string]bool{bundleManifest: true, bundleManifestHash: true}
+	for _, file := range manifest.Files {
+		data, ok := contents[file.Name]
+		if !ok {
+			return manifest, nil, errors.New(file.Name + ": missing")
+		} else if len(data) != file.Size || sha256Hex(data) != file.SHA256 {
+			return manifest, nil, errors.New(file.Name + ": bad checksum")
+		}
+		known[file.Name] = true
+	}
+	for name := range contents {
+		if !known[name] {
+			return manifest, nil, errors.New(name + ": not in manifest")
+		}
+	}
+	return manifest, contents, nil
+}
+
+// ImportPush pushes the data in a bundle made by Export on another
+// host, using the regid of that host. If that host was not registered,
+// we register it first and return the new regid; it should be stored
+// in the regid file on that host.
+func (r *Runner) ImportPush(rd io.Reader) (newRegid string, err error) {
+	manifest, contents, err := readBundle(rd)
+	if err != nil {
+		return "", err
+	}
+	log.Log.Printf("import: bundle of %s (regid %q), made %s",
+		manifest.FQDN, manifest.Regid, manifest.Created.Format(time.RFC3339))
+
+	if err = httpInit(r); err != nil {
+		return "", err
+	}
+	defer httpFinish()
+
+	ri := newRunInfo(r)
+	ri.coreIDData, err = data.NewCollected(contents[manifest.Files[0].Name])
+	if err != nil {
+		return "", fmt.Errorf("core.id: %s", err)
+	}
+	if ri.needsRegister() {
+		regid, ok := ri.requestRegid(ri.coreIDData)
+		if !ok {
+			return "", errors.New("register failed")
+		}
+		ri.coreIDData.SetString("regid", regid)
+		newRegid = regid
+	}
+
+	extraContext := map[string]string{}
+	for _, file := range manifest.Files {
+		if ri.isStopping() {
+			return newRegid, errors.New("stopped")
+		}
+		collected := ri.coreIDData
+		if file.Collector != "core.id" {
+			collected, err = data.NewCollected(contents[file.Name])
+			if err != nil {
+				return newRegid, fmt.Errorf("%s: %s", file.Name, err)
+			}
+		}
+		extraContext[PlaceholderCollector] = file.Collector
+		pushURL := ri.coreIDData.BuildString(r.PushURL, &extraContext)
+		result := ri.push(pushURL, collected, hashCollected(collected))
+		metricPushes.Add(1, result.Status)
+		if !result.ok() {
+			return newRegid, fmt.Errorf(
+				"push %s failed: %s", file.Collector, result.Reply)
+		}
+	}
+	return newRegid, nil
+}
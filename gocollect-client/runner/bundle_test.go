@@ -0,0 +1,147 @@
+package runner
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRunner_ExportImportPush(t *testing.T) {
+	discardLog(t)
+	dir, err := ioutil.TempDir("", "gocollect-bundle-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scripts := map[string]string{
+		"core.id": "echo '{\"fqdn\":\"h1.example.com\"}'",
+		"app.x":   "echo '{\"x\":1}'",
+	}
+	for name, script := range scripts {
+		err = ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte("#!/bin/sh\n"+script+"\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Export on the offline host, which is not registered.
+	var bundle bytes.Buffer
+	offline := Runner{CollectorsPaths: []string{dir}, Concurrency: 1}
+	if err = offline.Export(&bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken bundle is refused.
+	broken := bytes.Replace(bundle.Bytes(), []byte("{\"x\":1}"),
+		[]byte("{\"x\":2}"), 1)
+	_, err = offline.ImportPush(bytes.NewReader(broken))
+	if err == nil || !strings.Contains(err.Error(), "bad checksum") {
+		t.Errorf("broken bundle: got %v", err)
+	}
+
+	// Push it from the jump host.
+	var mutex sync.Mutex
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mutex.Lock()
+			got = append(got, r.URL.Path+" "+strings.TrimSpace(string(body)))
+			mutex.Unlock()
+			if r.URL.Path == "/register" {
+				w.Write([]byte("{\"data\":{\"regid\":\"R1\"}}"))
+			}
+		}))
+	defer server.Close()
+
+	jump := Runner{
+		RegisterURL: server.URL + "/register",
+		PushURL:     server.URL + "/push/{regid}/{_collector}"}
+	regid, err := jump.ImportPush(&bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regid != "R1" {
+		t.Errorf("regid: got %q", regid)
+	}
+	sort.Strings(got[1:])
+	expected := []string{
+		"/register {\"fqdn\":\"h1.example.com\",\"gocollect\":\"\"}",
+		"/push/R1/app.x {\"x\":1}",
+		("/push/R1/core.id {\"fqdn\":\"h1.example.com\"," +
+			"\"gocollect\":\"\",\"regid\":\"R1\"}"),
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s",
+			strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+// writeTestBundle writes a tar with a valid manifest for the data
+// entries, followed by the extra entries.
+func writeTestBundle(t *testing.T, extra ...string) *bytes.Buffer {
+	coreID := `{"fqdn":"h1"}`
+	manifest := bundleManifestInfo{
+		Version: bundleVersion, Files: []bundleFile{{
+			Collector: "core.id", Name: "data/core.id.json",
+			Size: len(coreID), SHA256: sha256Hex([]byte(coreID))}}}
+	encoded, _ := json.Marshal(manifest)
+	hash := sha256Hex(encoded) + "  " + bundleManifest + "\n"
+	entries := append([]string{
+		bundleManifest, string(encoded), bundleManifestHash, hash,
+		"data/core.id.json", coreID}, extra...)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < len(entries); i += 2 {
+		err := tw.WriteHeader(&tar.Header{
+			Name: entries[i], Mode: 0644, Size: int64(len(entries[i+1])),
+			Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = tw.Write([]byte(entries[i+1]))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	return &buf
+}
+
+func TestReadBundle_Refused(t *testing.T) {
+	if _, _, err := readBundle(writeTestBundle(t)); err != nil {
+		t.Fatalf("valid bundle: got %v", err)
+	}
+
+	saved := maxBundleEntrySize
+	maxBundleEntrySize = 1000
+	defer func() { maxBundleEntrySize = saved }()
+
+	tests := []struct {
+		extra    []string
+		expected string
+	}{
+		{[]string{"data/app.x.json", "{}"},
+			"data/app.x.json: not in manifest"},
+		{[]string{"data/core.id.json", `{"fqdn":"h2"}`},
+			"data/core.id.json: duplicate"},
+		{[]string{"big", strings.Repeat("x", 1001)}, "big: too large"},
+	}
+	for _, test := range tests {
+		_, _, err := readBundle(writeTestBundle(t, test.extra...))
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("%s: expected %q, got %v",
+				test.extra[0], test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"path/filepath"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
+// CollectorToggle enables or disables the collectors matching the
+// pattern (a collector key or a glob like "app.*").
+type CollectorToggle struct {
+	Pattern string
+	Enable  bool
+	// Where the toggle was set, like "file:line".
+	Source string
+}
+
+// KeyArgs holds extra arguments for the collectors matching the
+// pattern.
+type KeyArgs struct {
+	Pattern string
+	Args    []string
+}
+
+// KeyEnv holds an environment variable ("NAME=VALUE") for the
+// collectors matching the pattern.
+type KeyEnv struct {
+	Pattern string
+	Env     string
+}
+
+func matchKey(pattern string, collectorKey string) bool {
+	ok, _ := filepath.Match(pattern, collectorKey)
+	return ok
+}
+
+// configureCollectors applies the collector toggles, arguments,
+// environment and stderr limit to the collectors. For the toggles and
+// the arguments the *last* match wins; all matching environment
+// variables are set.
+func (r *Runner) configureCollectors(collectors *data.Collectors) {
+	for collectorKey, collector := range *collectors {
+		collector.StderrLimit = r.StderrLogLimit
+
+		if toggle := r.findToggle(collectorKey); toggle != nil {
+			if !toggle.Enable {
+				collector.IsEnabled = false
+				collector.Reason = "collector_disable at " + toggle.Source
+			} else if collector.Reason == "" {
+				collector.IsEnabled = true
+			}
+		}
+
+		for i := len(r.CollectorArgs) - 1; i >= 0; i-- {
+			if matchKey(r.CollectorArgs[i].Pattern, collectorKey) {
+				collector.Args = r.CollectorArgs[i].Args
+				break
+			}
+		}
+
+		for _, keyEnv := range r.CollectorEnv {
+			if matchKey(keyEnv.Pattern, collectorKey) {
+				collector.Env = append(collector.Env, keyEnv.Env)
+			}
+		}
+
+		(*collectors)[collectorKey] = collector
+	}
+}
+
+// findToggle returns the last toggle that matches the collector. The
+// core.id collector is always needed, so it cannot be toggled.
+func (r *Runner) findToggle(collectorKey string) *CollectorToggle {
+	if collectorKey == "core.id" {
+		return nil
+	}
+	for i := len(r.CollectorToggles) - 1; i >= 0; i-- {
+		if matchKey(r.CollectorToggles[i].Pattern, collectorKey) {
+			return &r.CollectorToggles[i]
+		}
+	}
+	return nil
+}
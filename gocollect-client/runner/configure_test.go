@@ -0,0 +1,60 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
+func TestRunner_configureCollectors(t *testing.T) {
+	r := Runner{
+		CollectorToggles: []CollectorToggle{
+			{"app.*", false, "a:1"},
+			{"app.lshw", true, "a:2"},
+			{"core.*", false, "a:3"},
+			{"core.foo", true, "a:4"},
+			{"app.broken", true, "a:5"},
+		},
+		CollectorArgs: []KeyArgs{
+			{"app.*", []string{"-v"}},
+			{"app.lshw", []string{"-short", "-quiet"}},
+		},
+		CollectorEnv: []KeyEnv{
+			{"app.*", "A=1"},
+			{"app.lshw", "B=2"},
+		},
+	}
+	collectors := data.Collectors{
+		"app.docker": {IsEnabled: true},
+		"app.lshw":   {IsEnabled: true},
+		"app.broken": {Reason: "not executable"},
+		"core.id":    {IsEnabled: true},
+		"core.foo":   {},
+		"core.meta":  {IsEnabled: true},
+	}
+	r.configureCollectors(&collectors)
+
+	runnable := strings.Join(collectors.GetRunnable(), ",")
+	if runnable != "core.foo,core.id,app.lshw" {
+		t.Errorf("runnable: got %s", runnable)
+	}
+	reason := collectors["app.docker"].Reason
+	if reason != "collector_disable at a:1" {
+		t.Errorf("app.docker reason: got %q", reason)
+	}
+	if reason = collectors["app.broken"].Reason; reason != "not executable" {
+		t.Errorf("app.broken reason: got %q", reason)
+	}
+
+	lshw := collectors["app.lshw"]
+	if args := strings.Join(lshw.Args, " "); args != "-short -quiet" {
+		t.Errorf("app.lshw args: got %q", args)
+	}
+	if env := strings.Join(lshw.Env, " "); env != "A=1 B=2" {
+		t.Errorf("app.lshw env: got %q", env)
+	}
+	if args := strings.Join(collectors["app.docker"].Args, " "); args != "-v" {
+		t.Errorf("app.docker args: got %q", args)
+	}
+}
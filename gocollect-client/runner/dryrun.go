@@ -0,0 +1,54 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ossobv/gocollect/gocollect-client/log"
+)
+
+// DryRunFunc receives the data of a collector and the URL that it
+// would be pushed to.
+type DryRunFunc func(collectorKey string, pushURL string, data []byte) error
+
+// DryRun runs all enabled collectors like Run, but passes the data to
+// write instead of pushing it. It does not register, and leaves the
+// state file and the outbox alone.
+func (r *Runner) DryRun(write DryRunFunc) error {
+	ri := newRunInfo(r)
+	if !ri.setCoreIDData() {
+		return errors.New("collector core.id failed")
+	}
+	if ri.needsRegister() {
+		log.Log.Printf("dry run: not registered; {regid} stays empty")
+	}
+
+	ctx, cancel := context.WithCancel(ri.ctx)
+	runs, wait := ri.startCollectors(ctx, ri.collectors.GetRunnable())
+	defer wait()
+	defer cancel()
+
+	extraContext := map[string]string{PlaceholderCollector: "<value>"}
+	for _, run := range runs {
+		if ri.isStopping() {
+			return errors.New("stopped")
+		}
+		collected := ri.finishCollector(ctx, run)
+		if ri.ctx.Err() != nil {
+			return errors.New("stopped")
+		}
+		if collected == nil || collected.IsEmpty() {
+			continue // nothing would be pushed
+		}
+		extraContext[PlaceholderCollector] = run.collectorKey
+		pushURL := ri.coreIDData.BuildString(r.PushURL, &extraContext)
+		err := write(run.collectorKey, pushURL, []byte(collected.String()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
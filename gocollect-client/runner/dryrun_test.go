@@ -0,0 +1,167 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunner_DryRun(t *testing.T) {
+	discardLog(t)
+	dir, err := ioutil.TempDir("", "gocollect-dryrun-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	collectorsPath := filepath.Join(dir, "collectors")
+	os.Mkdir(collectorsPath, 0755)
+	scripts := map[string]string{
+		"core.id": "echo '{\"fqdn\":\"h1.example.com\"}'",
+		"app.x":   "echo '{\"x\":1}'",
+		"app.y":   "echo '{\"y\":2}'",
+	}
+	for name, script := range scripts {
+		err = ioutil.WriteFile(filepath.Join(collectorsPath, name),
+			[]byte("#!/bin/sh\n"+script+"\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stateFilename := filepath.Join(dir, "state.json")
+	state := []byte("{\"collectors\":{}}\n")
+	if err = ioutil.WriteFile(stateFilename, state, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.URL.Path)
+		}))
+	defer server.Close()
+
+	regidFilename := filepath.Join(dir, "regid")
+	r := Runner{
+		CollectorsPaths: []string{collectorsPath},
+		RegisterURL:     server.URL + "/register",
+		PushURL:         server.URL + "/push/{regid}/{_collector}",
+		RegidFilename:   regidFilename,
+		StateFilename:   stateFilename,
+		OutboxPath:      filepath.Join(dir, "outbox"),
+		Concurrency:     1,
+	}
+	var got []string
+	err = r.DryRun(func(key string, pushURL string, data []byte) error {
+		pushURL = strings.TrimPrefix(pushURL, server.URL)
+		got = append(got, key+" "+pushURL+" "+
+			strings.TrimSpace(string(data)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	expected := []string{
+		"app.x /push//app.x {\"x\":1}",
+		"app.y /push//app.y {\"y\":2}",
+		("core.id /push//core.id {\"fqdn\":\"h1.example.com\"," +
+			"\"gocollect\":\"\"}"),
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s",
+			strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// Nothing was registered or pushed, and nothing was written.
+	if len(requests) != 0 {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+	if _, err = os.Stat(regidFilename); !os.IsNotExist(err) {
+		t.Errorf("regid file: expected none, got %v", err)
+	}
+	if _, err = os.Stat(r.OutboxPath); !os.IsNotExist(err) {
+		t.Errorf("outbox: expected none, got %v", err)
+	}
+	after, err := ioutil.ReadFile(stateFilename)
+	if err != nil || !bytes.Equal(after, state) {
+		t.Errorf("state file changed: %q, %v", after, err)
+	}
+}
+
+func TestRunner_DryRun_Cancelled(t *testing.T) {
+	discardLog(t)
+	dir, err := ioutil.TempDir("", "gocollect-dryrun-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "core.id"),
+		[]byte("#!/bin/sh\necho '{\"fqdn\":\"h1.example.com\"}'\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "app.slow"),
+		[]byte("#!/bin/sh\nsleep 30\n"), 0755)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	r := Runner{
+		CollectorsPaths: []string{dir}, Concurrency: 1, Context: ctx,
+		RegidFilename: filepath.Join(dir, "regid")}
+	var got []string
+	err = r.DryRun(func(key string, pushURL string, data []byte) error {
+		got = append(got, key)
+		return nil
+	})
+	if err == nil || err.Error() != "stopped" {
+		t.Errorf("expected stopped, got %v", err)
+	}
+	if strings.Join(got, " ") != "core.id" {
+		t.Errorf("expected only core.id, got %v", got)
+	}
+}
+
+func TestRunner_DryRun_Timeouts(t *testing.T) {
+	discardLog(t)
+	dir, err := ioutil.TempDir("", "gocollect-dryrun-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "core.id"),
+		[]byte("#!/bin/sh\necho '{\"fqdn\":\"h1.example.com\"}'\n"), 0755)
+	for _, key := range []string{"app.limited", "app.unlimited"} {
+		ioutil.WriteFile(filepath.Join(dir, key),
+			[]byte("#!/bin/sh\nsleep 0.5\necho '{\"done\":1}'\n"), 0755)
+	}
+
+	// A timeout of 0 is no limit, not some default.
+	r := Runner{
+		CollectorsPaths: []string{dir}, Concurrency: 2,
+		RegidFilename:    filepath.Join(dir, "regid"),
+		CollectorTimeout: 100 * time.Millisecond,
+		CollectorTimeouts: KeyDurations{
+			{Pattern: "app.unlimited", Duration: 0}}}
+	var got []string
+	err = r.DryRun(func(key string, pushURL string, data []byte) error {
+		if key != "core.id" {
+			got = append(got, key+" "+strings.TrimSpace(string(data)))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !strings.Contains(got[0], "ETIMEDOUT") ||
+		got[1] != "app.unlimited {\"done\":1}" {
+		t.Errorf("unexpected output:\n%s", strings.Join(got, "\n"))
+	}
+	if stall := r.MaxStall(); stall != 0 {
+		t.Errorf("expected no max stall, got %s", stall)
+	}
+}
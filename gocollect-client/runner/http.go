@@ -4,24 +4,89 @@
 package runner
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/ossobv/gocollect/gocollect-client/sanejoin"
 )
 
+// Maximum time for a single register or push call.
+const httpTimeout = 45 * time.Second
+
 var httpClient *http.Client
 var httpTransport *http.Transport
 
 // Do all HTTP initialization.
-func httpInit() {
+func httpInit(r *Runner) error {
+	tlsConfig, err := tlsConfigFromRunner(r)
+	if err != nil {
+		return err
+	}
+
 	// Set default HTTP options to with-keepalives (was the default
 	// anyway, but it's nice to be explicit) and set a 45s timeout.
 	httpTransport = &http.Transport{
-		DisableKeepAlives: false, MaxIdleConnsPerHost: 1}
+		DisableKeepAlives: false, MaxIdleConnsPerHost: 1,
+		TLSClientConfig: tlsConfig}
 	httpClient = &http.Client{
-		Transport: httpTransport, Timeout: 45 * time.Second}
+		Transport: httpTransport, Timeout: httpTimeout}
+	return nil
+}
+
+// Create the TLS config for the client certificate (mutual TLS) and
+// the private CA. Returns nil if nothing TLS related was configured,
+// so the Go defaults (system roots) are used.
+func tlsConfigFromRunner(r *Runner) (*tls.Config, error) {
+	if r.TLSCertFile == "" && r.TLSKeyFile == "" && r.TLSCAFile == "" &&
+		r.TLSServerName == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: r.TLSServerName}
+
+	// Optional client certificate. Both the certificate and the key are
+	// needed. Relative paths are relative to the config dir.
+	if r.TLSCertFile != "" || r.TLSKeyFile != "" {
+		if r.TLSCertFile == "" || r.TLSKeyFile == "" {
+			return nil, errors.New(
+				"tls_cert_file and tls_key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(
+			sanejoin.Join(r.ConfigPathBase, r.TLSCertFile),
+			sanejoin.Join(r.ConfigPathBase, r.TLSKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("tls client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Optional CA bundle. If set, we trust *only* these CAs and not the
+	// system roots.
+	if r.TLSCAFile != "" {
+		caFile := sanejoin.Join(r.ConfigPathBase, r.TLSCAFile)
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls ca: no certificates in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
 }
 
 // Do all HTTP cleanup/finalization.
@@ -32,16 +97,74 @@ func httpFinish() {
 	httpTransport.CloseIdleConnections()
 }
 
-// Perform a JSON HTTP POST call.
-func httpPost(url string, version string, data io.Reader) ([]byte, error) {
-	req, err := http.NewRequest("POST", url, data)
+// Compress the request body using the encoding (gzip or zstd). The
+// identity encoding returns the body as is.
+func httpEncodeBody(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "", PushEncodingIdentity:
+		return body, nil
+	case PushEncodingGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(body); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case PushEncodingZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(body, nil), nil
+	}
+	return nil, errors.New("unknown encoding " + encoding)
+}
+
+// Perform a JSON HTTP POST call. Optional extra headers are added to
+// the request. Returns the status code, the body and an error for
+// connection failures and non-2xx/3xx statuses.
+func httpPost(ctx context.Context, url string, version string,
+	data io.Reader, header http.Header) (int, []byte, error) {
+
+	return httpRequest(ctx, "POST", url, version, data, header)
+}
+
+// Perform an HTTP HEAD call. Returns the status code, and an error like
+// httpPost.
+func httpHead(ctx context.Context, url string, version string,
+	header http.Header) (int, error) {
+
+	status, _, err := httpRequest(ctx, "HEAD", url, version, nil, header)
+	return status, err
+}
+
+func httpRequest(ctx context.Context, method string, url string,
+	version string, data io.Reader, header http.Header) (
+	int, []byte, error) {
+
+	req, err := http.NewRequest(method, url, data)
+	if err != nil {
+		return 0, []byte(""), err
+	}
+	req = req.WithContext(ctx)
 	// req.Header.Set("Connection", "keep-alive") // HTTP/1.1 auto
 	req.Header.Set("User-Agent", "GoCollect/"+version)
-	req.Header.Set("Content-Type", "application/json")
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
 	resp, err := httpClient.Do(req)
 
 	var output []byte
+	var status int
 	if resp != nil {
+		status = resp.StatusCode
 		output, err = ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 	} else {
@@ -52,5 +175,5 @@ func httpPost(url string, version string, data io.Reader) ([]byte, error) {
 		err = errors.New("non-2xx/3xx status")
 	}
 
-	return output, err
+	return status, output, err
 }
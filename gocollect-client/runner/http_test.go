@@ -0,0 +1,196 @@
+package runner
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key, signed by the parent (or self
+// signed, if there is none).
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{name}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate (and key, if keyFile is set) to dir.
+func (c *testCert) writePEM(
+	t *testing.T, dir string, certFile string, keyFile string) {
+
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	ioutil.WriteFile(filepath.Join(dir, certFile), encoded, 0644)
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		ioutil.WriteFile(filepath.Join(dir, keyFile), encoded, 0600)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestHTTPInit_ClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocollect-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "Test CA", nil)
+	ca.writePEM(t, dir, "ca.crt", "")
+	client := newTestCert(t, "h1.example.com", ca)
+	client.writePEM(t, dir, "client.crt", "client.key")
+	server := newTestCert(t, "collector.example.com", ca)
+
+	// The server only talks to clients with a certificate from our CA.
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool}
+	ts.StartTLS()
+	defer ts.Close()
+
+	post := func(r *Runner) (string, error) {
+		if err := httpInit(r); err != nil {
+			return "", err
+		}
+		defer httpFinish()
+		_, body, err := httpPost(
+			context.Background(), ts.URL, "test", strings.NewReader("{}"), nil)
+		return string(body), err
+	}
+
+	// The server certificate is for collector.example.com, not for
+	// 127.0.0.1, so we need the ServerName.
+	r := Runner{
+		ConfigPathBase: dir, TLSCertFile: "client.crt",
+		TLSKeyFile: "client.key", TLSCAFile: "ca.crt",
+		TLSServerName: "collector.example.com"}
+	if body, err := post(&r); err != nil || body != "h1.example.com" {
+		t.Errorf("client cert: got %q, %v", body, err)
+	}
+
+	noServerName := r
+	noServerName.TLSServerName = ""
+	if _, err := post(&noServerName); err == nil {
+		t.Errorf("no server name: expected an error")
+	}
+
+	noClientCert := r
+	noClientCert.TLSCertFile, noClientCert.TLSKeyFile = "", ""
+	if _, err := post(&noClientCert); err == nil {
+		t.Errorf("no client cert: expected an error")
+	}
+
+	// Without our CA, the server is not trusted.
+	systemRoots := r
+	systemRoots.TLSCAFile = ""
+	if _, err := post(&systemRoots); err == nil {
+		t.Errorf("system roots: expected an error")
+	}
+}
+
+func TestTLSConfigFromRunner_Errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocollect-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "Test CA", nil)
+	ca.writePEM(t, dir, "ca.crt", "ca.key")
+	ioutil.WriteFile(filepath.Join(dir, "bad.crt"), []byte("nope\n"), 0644)
+
+	if config, err := tlsConfigFromRunner(&Runner{}); config != nil ||
+		err != nil {
+		t.Errorf("no tls: got %v, %v", config, err)
+	}
+
+	tests := []struct {
+		runner   Runner
+		expected string
+	}{
+		{Runner{TLSKeyFile: "ca.key"},
+			"tls_cert_file and tls_key_file must be set together"},
+		{Runner{TLSCertFile: "ca.crt", TLSKeyFile: "missing.key"},
+			"tls client certificate: open "},
+		{Runner{TLSCAFile: "missing.crt"}, "tls ca: open "},
+		{Runner{TLSCAFile: "bad.crt"}, "tls ca: no certificates in "},
+	}
+	for _, test := range tests {
+		test.runner.ConfigPathBase = dir
+		_, err := tlsConfigFromRunner(&test.runner)
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("%+v: expected %q, got %v", test.runner,
+				test.expected, err)
+		}
+	}
+
+	// Absolute paths are used as is.
+	config, err := tlsConfigFromRunner(&Runner{
+		ConfigPathBase: "/nonexistent",
+		TLSCAFile:      filepath.Join(dir, "ca.crt"),
+		TLSServerName:  "collector.example.com"})
+	if err != nil || config.RootCAs == nil ||
+		config.ServerName != "collector.example.com" {
+		t.Errorf("absolute ca: got %v, %v", config, err)
+	}
+}
@@ -4,10 +4,14 @@
 package runner
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/ossobv/gocollect/gocollect-client/data"
 	"github.com/ossobv/gocollect/gocollect-client/log"
@@ -15,9 +19,16 @@ import (
 )
 
 type runInfo struct {
+	ctx        context.Context
 	runner     *Runner
 	collectors *data.Collectors
 	coreIDData data.Collected
+	outbox     *outbox
+	state      *runState
+	summary    *runSummary
+	// Content-Encoding for pushes; reset to identity when the server
+	// does not accept it.
+	pushEncoding string
 }
 
 type runStatus int
@@ -26,25 +37,33 @@ const (
 	runSuccess runStatus = iota
 	runFailedFirst
 	runFailedSome
+	runStopped
 )
 
 func newRunInfo(r *Runner) (ri runInfo) {
+	ri.ctx = r.Context
+	if ri.ctx == nil {
+		ri.ctx = context.Background()
+	}
 	ri.runner = r
 	ri.collectors = data.MergeCollectors(
 		&data.BuiltinCollectors, shcollectors.Find(r.CollectorsPaths))
+	r.configureCollectors(ri.collectors)
+	ri.outbox = newOutbox(r)
+	ri.pushEncoding = r.PushEncoding
 	return ri
 }
 
 func (ri *runInfo) setCoreIDData() bool {
-	ri.coreIDData = ri.collectors.Run("core.id")
+	ri.coreIDData = ri.collectors.Run(ri.ctx, "core.id")
 	if ri.coreIDData == nil {
 		return false
 	}
 
 	// Patch core.id with our version and optional apiKey.
-	ri.coreIDData.SetString("gocollect", ri.runner.GoCollectVersion)
+	ri.coreIDData.SetString(PlaceholderVersion, ri.runner.GoCollectVersion)
 	if ri.runner.APIKey != "" {
-		ri.coreIDData.SetString("gocollect-apikey", ri.runner.APIKey)
+		ri.coreIDData.SetString(PlaceholderAPIKey, ri.runner.APIKey)
 	}
 
 	return true
@@ -65,7 +84,7 @@ func (ri *runInfo) runRegister() bool {
 
 		// Re-get core.id data: this time we must have regid or core.id
 		// is broken (or the registration helper).
-		ri.coreIDData = ri.collectors.Run("core.id")
+		ri.coreIDData = ri.collectors.Run(ri.ctx, "core.id")
 		if ri.coreIDData == nil {
 			return false
 		}
@@ -80,15 +99,118 @@ func (ri *runInfo) runRegister() bool {
 	return true
 }
 
-func (ri *runInfo) runAll() runStatus {
+// run fetches the core info, registers if needed, and runs the
+// selected collectors.
+func (ri *runInfo) run(selected collectorFilter) bool {
+	// Initialize HTTP calls.
+	if err := httpInit(ri.runner); err != nil {
+		log.Log.Printf("http: %s", err)
+		return false
+	}
+	defer httpFinish()
+
+	// Fetch the core info -- which also fetches the regid.
+	ri.progress("running collector core.id")
+	if !ri.setCoreIDData() {
+		return false
+	}
+
+	// Check if we need to register first.
+	if ri.needsRegister() {
+		ri.progress("registering")
+		if !ri.runRegister() {
+			return false
+		}
+	}
+
+	// Then run all collectors.
+	if ri.runAll(selected) != runSuccess {
+		return false
+	}
+	return true
+}
+
+// isStopping returns true if we're shutting down: no new collectors
+// should be started.
+func (ri *runInfo) isStopping() bool {
+	select {
+	case <-ri.runner.Stop:
+		return true
+	default:
+		return ri.ctx.Err() != nil
+	}
+}
+
+// progress reports what we are doing, if anyone is interested.
+func (ri *runInfo) progress(status string) {
+	if ri.runner.Progress != nil {
+		ri.runner.Progress(status)
+	}
+}
+
+// collectorFilter selects the collectors to run.
+type collectorFilter func(ri *runInfo, collectorKey string) bool
+
+// runAll runs the selected collectors (all if selected is nil) and
+// pushes the data.
+func (ri *runInfo) runAll(selected collectorFilter) runStatus {
 	ret := runSuccess
 	collectors := 0
 
-	// Run all collectors and push.
-	extraContext := map[string]string{"_collector": "<value>"}
+	// Deliver what is left over from previous runs first. If that
+	// fails, don't bother the server again during this run.
+	serverBroken := !ri.replayOutbox()
+	if serverBroken {
+		ret = runFailedFirst
+		if ri.outbox == nil {
+			return ret
+		}
+	}
+
+	// Select the collectors to run.
+	var keys []string
 	for _, collectorKey := range ri.collectors.GetRunnable() {
+		if selected == nil || selected(ri, collectorKey) {
+			keys = append(keys, collectorKey)
+		}
+	}
+
+	// Start them, possibly concurrently. We stop the ones still running
+	// when we're done.
+	ctx, cancel := context.WithCancel(ri.ctx)
+	runs, wait := ri.startCollectors(ctx, keys)
+	defer wait()
+	defer cancel()
+
+	// Run all collectors and push, in order.
+	extraContext := map[string]string{PlaceholderCollector: "<value>"}
+	for _, run := range runs {
+		collectorKey := run.collectorKey
+		if ri.isStopping() {
+			log.Log.Printf("shutdown: not running the other collectors")
+			ret = runStopped
+			break
+		}
+
 		// Run a (patched) collector.
-		collected := ri.runCollector(collectorKey)
+		collected := ri.finishCollector(ctx, run)
+		if ri.ctx.Err() != nil {
+			log.Log.Printf("collector[%s]: aborted; shutting down",
+				collectorKey)
+			ret = runStopped
+			break
+		}
+		startTime := run.startTime
+		if ri.runner.KeepStderr && collectorKey != "core.id" {
+			ri.state.get(collectorKey).Stderr = run.report.Stderr
+		}
+		ri.state.setRunResult(run)
+		outcome := ri.state.get(collectorKey).Outcome
+		observeCollectorRun(run, outcome)
+		ri.summary.Collectors++
+		if outcome != "ok" {
+			ri.summary.Failed++
+		}
 		if collected == nil {
 			// logger.Printf(
 			//     "collector[%s]: exec fail", collectorKey)
@@ -97,26 +219,146 @@ func (ri *runInfo) runAll() runStatus {
 
 		// We update the pushURL for every push because the _collector
 		// is in it, which changes continuously.
-		extraContext["_collector"] = collectorKey
+		extraContext[PlaceholderCollector] = collectorKey
 		pushURL := ri.coreIDData.BuildString(ri.runner.PushURL, &extraContext)
 
-		if !ri.push(pushURL, collected) {
-			log.Log.Printf("push: aborting early; assuming server is broken")
+		ri.progress("pushing " + collectorKey)
+		if serverBroken {
+			ri.deliverLater(run, newPushResult(
+				pushStatusFailed, 0, "not tried; server is broken"))
+			continue
+		}
+
+		result := ri.pushCollected(collectorKey, pushURL, collected)
+		ri.state.setPushResult(collectorKey, result)
+		metricPushes.Add(1, result.Status)
+		if !result.ok() && ri.ctx.Err() != nil {
+			log.Log.Printf("push[url=%s]: aborted; shutting down", pushURL)
+			ri.deliverLater(run, result)
+			ret = runStopped
+			break
+		} else if !result.ok() {
 			if collectors == 0 {
 				ret = runFailedFirst
 			} else {
 				ret = runFailedSome
 			}
-			break
+			if ri.outbox == nil {
+				log.Log.Printf(
+					"push: aborting early; assuming server is broken")
+				break
+			}
+			log.Log.Printf(
+				"push: assuming server is broken; storing in outbox")
+			serverBroken = true
+			ri.deliverLater(run, result)
+			continue
 		}
 
+		ri.state.setRun(collectorKey, startTime)
 		collectors += 1
 	}
 
+	if ri.outbox != nil {
+		ri.outbox.prune()
+	}
 	return ret
 }
 
-func (ri *runInfo) runCollector(collectorKey string) data.Collected {
+// replayOutbox pushes the undelivered data of previous runs, oldest
+// first, to the current push URL. Returns false if the server is still
+// unreachable. An entry that the server refuses is kept for the next
+// run (or dropped, if the server says the data is bad), but the other
+// entries are pushed nonetheless.
+func (ri *runInfo) replayOutbox() bool {
+	if ri.outbox == nil {
+		return true
+	}
+
+	extraContext := map[string]string{PlaceholderCollector: "<value>"}
+	for _, entry := range ri.outbox.entries() {
+		if ri.isStopping() {
+			return false
+		}
+		collected, err := data.NewCollected(entry.Data)
+		if err != nil {
+			log.Log.Printf("outbox[%s]: dropping bad entry: %s",
+				entry.Collector, err)
+			ri.outbox.remove(entry.Collector)
+			continue
+		}
+
+		ri.progress("replaying outbox " + entry.Collector)
+		log.Log.Printf("outbox[%s]: replaying data from %s",
+			entry.Collector, entry.Time.Format(time.RFC3339))
+		extraContext[PlaceholderCollector] = entry.Collector
+		pushURL := ri.coreIDData.BuildString(ri.runner.PushURL, &extraContext)
+		hash := hashCollected(collected)
+		result := ri.push(pushURL, collected, hash)
+		metricPushes.Add(1, result.Status)
+		switch {
+		case result.ok():
+		case result.Code == 0:
+			log.Log.Printf("outbox: aborting replay; server still broken")
+			return false
+		case result.Code >= 400 && result.Code < 500 &&
+			result.Code != http.StatusRequestTimeout &&
+			result.Code != http.StatusTooManyRequests:
+			log.Log.Printf("outbox[%s]: dropping entry; refused with %d",
+				entry.Collector, result.Code)
+			ri.state.setPushResult(entry.Collector, result)
+			ri.outbox.remove(entry.Collector)
+			continue
+		default:
+			log.Log.Printf("outbox[%s]: replay failed; keeping it",
+				entry.Collector)
+			continue
+		}
+		ri.state.setPushed(entry.Collector, hash)
+		ri.state.setPushResult(entry.Collector, result)
+		ri.outbox.remove(entry.Collector)
+	}
+	return true
+}
+
+// deliverLater stores the collected data of the run in the outbox, and
+// records the (failed) push result.
+func (ri *runInfo) deliverLater(run *collectorRun, failed pushResult) {
+	collectorKey := run.collectorKey
+	if !ri.storeInOutbox(collectorKey, run.collected) {
+		ri.state.setPushResult(collectorKey, failed)
+		return
+	}
+	if run.collected.IsEmpty() {
+		failed = newPushResult(pushStatusEmpty, 0, "")
+	} else {
+		failed.Status = pushStatusOutbox
+	}
+	ri.state.setPushResult(collectorKey, failed)
+	metricPushes.Add(1, failed.Status)
+	ri.state.setRun(collectorKey, run.startTime)
+}
+
+// storeInOutbox saves undelivered collected data for a later run.
+// Returns true if the data is taken care of.
+func (ri *runInfo) storeInOutbox(
+	collectorKey string, collected data.Collected) bool {
+
+	if ri.outbox == nil {
+		return false
+	} else if collected.IsEmpty() {
+		return true
+	}
+	if err := ri.outbox.store(collectorKey, collected); err != nil {
+		log.Log.Printf("outbox[%s]: store failed: %s", collectorKey, err)
+		return false
+	}
+	return true
+}
+
+func (ri *runInfo) runCollector(
+	ctx context.Context, collectorKey string) data.Collected {
+
 	switch collectorKey {
 	case "core.id":
 		// Use helper.
@@ -125,57 +367,189 @@ func (ri *runInfo) runCollector(collectorKey string) data.Collected {
 		}
 		return ri.coreIDData
 	default:
-		// Exec the collector.
-		return ri.collectors.Run(collectorKey)
+		// Exec the collector, with a time limit (unless it is 0).
+		timeout := ri.runner.CollectorTimeouts.Get(
+			collectorKey, ri.runner.CollectorTimeout)
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return ri.collectors.Run(ctx, collectorKey)
 	}
 }
 
 func (ri *runInfo) register(coreIDData data.Collected) bool {
+	value, ok := ri.requestRegid(coreIDData)
+	if !ok {
+		return false
+	}
+
+	os.MkdirAll(filepath.Dir(ri.runner.RegidFilename), 0755)
+	err := ioutil.WriteFile(ri.runner.RegidFilename, []byte(value), 0400)
+	if err != nil {
+		log.Log.Fatal("Could not write core.id.regid: ", err)
+		return false
+	}
+	return true
+}
+
+// requestRegid registers the core.id data at the register URL and
+// returns the regid we got.
+func (ri *runInfo) requestRegid(
+	coreIDData data.Collected) (regid string, ok bool) {
+
 	registerURL := ri.runner.RegisterURL
+	defer func() {
+		if ok {
+			metricRegisterAttempts.Add(1, "ok")
+		} else {
+			metricRegisterAttempts.Add(1, "failed")
+		}
+	}()
 
-	// Post data, expect {"data":{"regid":"12345"}}.
-	data, err := httpPost(registerURL, ri.runner.GoCollectVersion, coreIDData)
+	// Post data, expect {"data":{"regid":"12345"}}. (Post a copy: the
+	// collected data cannot be altered once it has been read.)
+	_, data, err := httpPost(
+		ri.ctx, registerURL, ri.runner.GoCollectVersion,
+		bytes.NewReader([]byte(coreIDData.String())), nil)
 	if err != nil {
 		log.Log.Printf("register[url=%s]: failed: %s", registerURL, err)
-		return false
+		return "", false
 	}
 
 	var decoded map[string](map[string]string)
 	err = json.Unmarshal(data, &decoded)
 	if err != nil {
 		log.Log.Printf("register[url=%s]: failed: %s", registerURL, err)
-		return false
+		return "", false
 	}
 
 	value := decoded["data"]["regid"]
 	if value == "" {
 		log.Log.Printf("register[url=%s]: failed: got nothing", registerURL)
-		return false
+		return "", false
 	}
 
-	os.MkdirAll(filepath.Dir(ri.runner.RegidFilename), 0755)
-	err = ioutil.WriteFile(ri.runner.RegidFilename, []byte(value), 0400)
-	if err != nil {
-		log.Log.Fatal("Could not write core.id.regid: ", err)
-		return false
+	log.Log.Printf("register[url=%s]: got %s", registerURL, value)
+	return value, true
+}
+
+// pushCollected pushes the collected data, unless the server already
+// has it.
+func (ri *runInfo) pushCollected(
+	collectorKey string, pushURL string, collected data.Collected) pushResult {
+
+	hash := hashCollected(collected)
+	if !collected.IsEmpty() && ri.state.isUnchanged(
+		collectorKey, hash, ri.runner.PushFullInterval) {
+		switch ri.runner.PushUnchanged {
+		case PushUnchangedSkip:
+			log.Log.Printf("push[url=%s]: unchanged; skipping", pushURL)
+			return newPushResult(pushStatusUnchanged, 0, "")
+		case PushUnchangedConditional:
+			unchanged, result := ri.pushConditional(pushURL, hash)
+			if unchanged || !result.ok() {
+				return result
+			}
+			// The server wants the data after all.
+		}
 	}
 
-	log.Log.Printf("register[url=%s]: got %s", registerURL, value)
-	return true
+	result := ri.push(pushURL, collected, hash)
+	if result.Status == pushStatusPushed {
+		ri.state.setPushed(collectorKey, hash)
+	}
+	return result
 }
 
-func (ri *runInfo) push(pushURL string, collectedData data.Collected) bool {
+// pushConditional asks the server whether it still has the data with
+// this hash, without sending the data: a HEAD request, so a server
+// that knows nothing about this cannot mistake it for (empty) data. A
+// 304 reply means that it has it; any other reply (error statuses
+// included) asks for the full data. Only a failing connection counts
+// as a failed push.
+func (ri *runInfo) pushConditional(
+	pushURL string, hash string) (unchanged bool, result pushResult) {
+
+	header := http.Header{}
+	header.Set("If-None-Match", "\""+hash+"\"")
+	status, err := httpHead(
+		ri.ctx, pushURL, ri.runner.GoCollectVersion, header)
+	if status == 0 {
+		log.Log.Printf("push[url=%s]: conditional failed: %s", pushURL, err)
+		return false, newPushResult(pushStatusFailed, status, err.Error())
+	}
+	if status == http.StatusNotModified {
+		log.Log.Printf("push[url=%s]: unchanged; confirmed", pushURL)
+		observePushed(0)
+		return true, newPushResult(pushStatusUnchanged, status, "")
+	}
+	log.Log.Printf("push[url=%s]: conditional got %d; sending full data",
+		pushURL, status)
+	return false, newPushResult(pushStatusPushed, status, "")
+}
+
+func (ri *runInfo) push(
+	pushURL string, collectedData data.Collected, hash string) pushResult {
+
 	if collectedData.IsEmpty() {
 		log.Log.Printf("push[url=%s]: not pushing empty data", pushURL)
-		return true
+		return newPushResult(pushStatusEmpty, 0, "")
 	}
 
-	data, err := httpPost(pushURL, ri.runner.GoCollectVersion, collectedData)
+	header := http.Header{}
+	header.Set("X-GoCollect-Hash", hash)
+	status, data, err := ri.postEncoded(
+		pushURL, []byte(collectedData.String()), header)
 	if err != nil {
 		log.Log.Printf("push[url=%s]: failed: %s", pushURL, err)
-		return false
+		reply := err.Error()
+		if len(data) != 0 {
+			reply += ": " + string(data)
+		}
+		return newPushResult(pushStatusFailed, status, reply)
 	}
 
 	log.Log.Printf("push[url=%s]: got %s", pushURL, string(data))
-	return true
+	return newPushResult(pushStatusPushed, status, string(data))
+}
+
+// postEncoded posts the body, compressed using the push encoding. If
+// the server does not accept the encoding (415), we send the plain
+// body instead and stick to that for the rest of the run.
+func (ri *runInfo) postEncoded(
+	url string, body []byte, header http.Header) (int, []byte, error) {
+
+	if ri.pushEncoding != "" && ri.pushEncoding != PushEncodingIdentity {
+		encoded, err := httpEncodeBody(ri.pushEncoding, body)
+		if err != nil {
+			log.Log.Printf("push[url=%s]: %s encoding failed: %s",
+				url, ri.pushEncoding, err)
+		} else {
+			header.Set("Content-Encoding", ri.pushEncoding)
+			status, output, err := httpPost(
+				ri.ctx, url, ri.runner.GoCollectVersion,
+				bytes.NewReader(encoded), header)
+			if status != http.StatusUnsupportedMediaType {
+				if err == nil {
+					observePushed(len(encoded))
+				}
+				return status, output, err
+			}
+			log.Log.Printf(
+				"push[url=%s]: server does not accept %s; sending plain",
+				url, ri.pushEncoding)
+			header.Del("Content-Encoding")
+		}
+		ri.pushEncoding = PushEncodingIdentity
+	}
+
+	status, output, err := httpPost(
+		ri.ctx, url, ri.runner.GoCollectVersion, bytes.NewReader(body),
+		header)
+	if err == nil {
+		observePushed(len(body))
+	}
+	return status, output, err
 }
@@ -0,0 +1,96 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+	"github.com/ossobv/gocollect/gocollect-client/shcollectors"
+)
+
+// CollectorInfo describes a collector and where it came from.
+type CollectorInfo struct {
+	Key string `json:"key"`
+	// Either "builtin" or "script".
+	Type string `json:"type"`
+	// The script that is used, and the scripts (or "builtin") that it
+	// overrides.
+	Path     string   `json:"path,omitempty"`
+	Shadowed []string `json:"shadowed,omitempty"`
+	// Whether it is run, and if not, why.
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	// The parsed "# REQUIRES:" header of the script.
+	Requires []shcollectors.Requirement `json:"requires,omitempty"`
+	// Extra arguments and environment from the config.
+	Args []string `json:"args,omitempty"`
+	Env  []string `json:"env,omitempty"`
+}
+
+// ListCollectors returns all builtin collectors and collector scripts,
+// in run order, the enabled ones first.
+func (r *Runner) ListCollectors() (ret []CollectorInfo) {
+	ri := newRunInfo(r)
+	scripts := shcollectors.Scan(r.CollectorsPaths)
+
+	var enabled, disabled []string
+	for key, collector := range *ri.collectors {
+		if collector.IsEnabled {
+			enabled = append(enabled, key)
+		} else {
+			disabled = append(disabled, key)
+		}
+	}
+	data.SortKeys(enabled)
+	data.SortKeys(disabled)
+
+	for _, key := range append(enabled, disabled...) {
+		collector := (*ri.collectors)[key]
+		info := CollectorInfo{
+			Key: key, Type: "builtin", Enabled: collector.IsEnabled,
+			Reason: collector.Reason, Args: collector.Args,
+			Env: collector.Env}
+		if script, ok := scripts[key]; ok {
+			info.Type = "script"
+			info.Path = script.Path
+			info.Shadowed = script.Shadowed
+			info.Requires = script.Requires
+			if _, ok := data.BuiltinCollectors[key]; ok {
+				info.Shadowed = append([]string{"builtin"}, info.Shadowed...)
+			}
+		}
+		if !info.Enabled && info.Reason == "" {
+			info.Reason = "disabled by default"
+		}
+		ret = append(ret, info)
+	}
+	return ret
+}
+
+// WriteCollectors writes a human readable list of the collectors.
+func WriteCollectors(w io.Writer, list []CollectorInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "COLLECTOR\tTYPE\tENABLED\tPATH\tREQUIRES\n")
+	for _, info := range list {
+		enabled := "yes"
+		if !info.Enabled {
+			enabled = "no (" + info.Reason + ")"
+		}
+		requires := make([]string, len(info.Requires))
+		for i, req := range info.Requires {
+			requires[i] = req.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			info.Key, info.Type, enabled, statusOrDash(info.Path),
+			statusOrDash(strings.Join(requires, ", ")))
+		for _, shadowed := range info.Shadowed {
+			fmt.Fprintf(tw, "\t\t\t(overrides %s)\t\n", shadowed)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,16 @@
+package runner
+
+import (
+	"io/ioutil"
+	golog "log"
+	"testing"
+
+	"github.com/ossobv/gocollect/gocollect-client/log"
+)
+
+// discardLog silences the global logger until the test is done.
+func discardLog(t *testing.T) {
+	saved := log.Log
+	log.Log = golog.New(ioutil.Discard, "", 0)
+	t.Cleanup(func() { log.Log = saved })
+}
@@ -0,0 +1,83 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/metrics"
+)
+
+var (
+	metricRuns = metrics.NewCounter(
+		"gocollect_runs_total", "Number of runs, by result.", "result")
+	metricRunDuration = metrics.NewGauge(
+		"gocollect_run_duration_seconds", "Duration of the last run.")
+	metricCollectorRuns = metrics.NewCounter(
+		"gocollect_collector_runs_total",
+		"Number of collector runs, by outcome.", "collector", "outcome")
+	metricCollectorDuration = metrics.NewGauge(
+		"gocollect_collector_duration_seconds",
+		"Duration of the last collector run.", "collector")
+	metricCollectorFailures = metrics.NewCounter(
+		"gocollect_collector_failures_total",
+		"Number of failed collector runs (including timeouts).",
+		"collector")
+	metricCollectorTimeouts = metrics.NewCounter(
+		"gocollect_collector_timeouts_total",
+		"Number of collector runs that were killed after the timeout.",
+		"collector")
+	metricPushes = metrics.NewCounter(
+		"gocollect_pushes_total", "Number of pushes, by status.", "status")
+	metricPushedBytes = metrics.NewCounter(
+		"gocollect_pushed_bytes_total",
+		"Number of bytes (request bodies) pushed successfully.")
+	metricRegisterAttempts = metrics.NewCounter(
+		"gocollect_register_attempts_total",
+		"Number of register attempts, by result.", "result")
+	metricLastPush = metrics.NewGauge(
+		"gocollect_last_push_success_timestamp_seconds",
+		"Time of the last successful push.")
+	_ = metrics.NewGaugeFunc(
+		"gocollect_seconds_since_last_push_success",
+		"Seconds since the last successful push.", secondsSinceLastPush)
+)
+
+var (
+	lastPushMutex sync.Mutex
+	lastPush      time.Time
+)
+
+func secondsSinceLastPush() (float64, bool) {
+	lastPushMutex.Lock()
+	defer lastPushMutex.Unlock()
+	if lastPush.IsZero() {
+		return 0, false
+	}
+	return time.Since(lastPush).Seconds(), true
+}
+
+func observePushed(size int) {
+	now := time.Now()
+	lastPushMutex.Lock()
+	lastPush = now
+	lastPushMutex.Unlock()
+	metricLastPush.Set(float64(now.UnixNano()) / 1e9)
+	metricPushedBytes.Add(float64(size))
+}
+
+// observeCollectorRun updates the collector metrics with the outcome of
+// the run.
+func observeCollectorRun(run *collectorRun, outcome string) {
+	key := run.collectorKey
+	metricCollectorRuns.Add(1, key, outcome)
+	metricCollectorDuration.Set(run.duration.Seconds(), key)
+	if outcome != "ok" {
+		metricCollectorFailures.Add(1, key)
+	}
+	if outcome == "timeout" {
+		metricCollectorTimeouts.Add(1, key)
+	}
+}
@@ -0,0 +1,144 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+	"github.com/ossobv/gocollect/gocollect-client/log"
+)
+
+// outbox is a spool directory with pushes that could not be delivered.
+// Every collector gets a single file, so only the newest snapshot per
+// collector is kept. The entries are replayed (oldest first) on the
+// next run, to the push URL of that run: the push_url or regid may
+// have changed in the meantime.
+type outbox struct {
+	path    string
+	maxAge  time.Duration
+	maxSize int64
+}
+
+// outboxEntry is the on-disk format of a single undelivered push.
+type outboxEntry struct {
+	Collector string          `json:"collector"`
+	Time      time.Time       `json:"time"`
+	Data      json.RawMessage `json:"data"`
+
+	size int64 // file size, for the size limit
+}
+
+const outboxSuffix = ".json"
+
+// newOutbox returns the outbox for the runner, or nil if it is
+// disabled.
+func newOutbox(r *Runner) *outbox {
+	if r.OutboxPath == "" {
+		return nil
+	}
+	return &outbox{
+		path: r.OutboxPath, maxAge: r.OutboxMaxAge, maxSize: r.OutboxMaxSize}
+}
+
+func (o *outbox) filename(collectorKey string) string {
+	return filepath.Join(o.path, collectorKey+outboxSuffix)
+}
+
+// store atomically writes the collected data to the outbox, replacing
+// any older snapshot of the same collector.
+func (o *outbox) store(collectorKey string, collected data.Collected) error {
+	encoded, err := json.Marshal(&outboxEntry{
+		Collector: collectorKey,
+		Time:      time.Now(),
+		Data:      json.RawMessage(collected.String()),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(o.path, 0700); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(o.filename(collectorKey), encoded, 0600)
+}
+
+// remove drops the entry of the collector from the outbox.
+func (o *outbox) remove(collectorKey string) {
+	err := os.Remove(o.filename(collectorKey))
+	if err != nil && !os.IsNotExist(err) {
+		log.Log.Printf("outbox[%s]: %s", collectorKey, err)
+	}
+}
+
+// entries returns all valid outbox entries, oldest first. Expired and
+// unreadable entries are removed.
+func (o *outbox) entries() (entries []outboxEntry) {
+	filelist, err := ioutil.ReadDir(o.path)
+	if err != nil {
+		return nil
+	}
+
+	for _, fileinfo := range filelist {
+		name := fileinfo.Name()
+		if fileinfo.IsDir() || strings.HasPrefix(name, ".") ||
+			!strings.HasSuffix(name, outboxSuffix) {
+			continue
+		}
+		collectorKey := name[0 : len(name)-len(outboxSuffix)]
+
+		var entry outboxEntry
+		encoded, err := ioutil.ReadFile(filepath.Join(o.path, name))
+		if err == nil {
+			err = json.Unmarshal(encoded, &entry)
+		}
+		if err != nil || entry.Collector != collectorKey {
+			log.Log.Printf("outbox[%s]: dropping bad entry: %v",
+				collectorKey, err)
+			o.remove(collectorKey)
+			continue
+		}
+		if o.maxAge > 0 && time.Since(entry.Time) > o.maxAge {
+			log.Log.Printf("outbox[%s]: dropping entry from %s: too old",
+				collectorKey, entry.Time.Format(time.RFC3339))
+			o.remove(collectorKey)
+			continue
+		}
+
+		entry.size = fileinfo.Size()
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries
+}
+
+// prune enforces the age and size limits on the outbox, dropping the
+// oldest entries first.
+func (o *outbox) prune() {
+	entries := o.entries()
+	if o.maxSize <= 0 {
+		return
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+	}
+	for i := 0; total > o.maxSize && i < len(entries); i++ {
+		log.Log.Printf("outbox[%s]: dropping entry from %s: outbox full",
+			entries[i].Collector, entries[i].Time.Format(time.RFC3339))
+		o.remove(entries[i].Collector)
+		total -= entries[i].size
+	}
+}
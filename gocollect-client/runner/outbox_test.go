@@ -0,0 +1,127 @@
+package runner
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
+func newTestOutbox(t *testing.T) *outbox {
+	discardLog(t)
+	path, err := ioutil.TempDir("", "gocollect-outbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &outbox{path: path, maxAge: time.Hour}
+}
+
+func mustCollected(t *testing.T, s string) data.Collected {
+	collected, err := data.NewCollected([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return collected
+}
+
+func TestOutbox_NewestPerCollector(t *testing.T) {
+	o := newTestOutbox(t)
+	defer os.RemoveAll(o.path)
+
+	o.store("os.pkg", mustCollected(t, `{"v":1}`))
+	o.store("core.id", mustCollected(t, `{"v":2}`))
+	o.store("os.pkg", mustCollected(t, `{"v":3}`))
+
+	entries := o.entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Collector != "core.id" || entries[1].Collector != "os.pkg" {
+		t.Errorf("unexpected order: %s, %s",
+			entries[0].Collector, entries[1].Collector)
+	}
+	if string(entries[1].Data) != `{"v":3}` {
+		t.Errorf("expected newest os.pkg data, got %q", entries[1].Data)
+	}
+
+	o.remove("core.id")
+	if entries = o.entries(); len(entries) != 1 {
+		t.Errorf("expected 1 entry after remove, got %d", len(entries))
+	}
+}
+
+func TestOutbox_PruneSize(t *testing.T) {
+	o := newTestOutbox(t)
+	defer os.RemoveAll(o.path)
+
+	o.store("a.one", mustCollected(t, `{"v":1}`))
+	o.store("a.two", mustCollected(t, `{"v":2}`))
+	o.maxSize = o.entries()[1].size
+	o.prune()
+
+	entries := o.entries()
+	if len(entries) != 1 || entries[0].Collector != "a.two" {
+		t.Errorf("expected only the newest entry to survive, got %v",
+			entries)
+	}
+}
+
+func TestRunInfo_replayOutbox(t *testing.T) {
+	o := newTestOutbox(t)
+	defer os.RemoveAll(o.path)
+	for _, key := range []string{"a.gone", "a.fail", "a.ok"} {
+		o.store(key, mustCollected(t, `{"v":1}`))
+		time.Sleep(time.Millisecond) // keep the order
+	}
+
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			got = append(got, r.URL.Path)
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/a.gone"):
+				w.WriteHeader(http.StatusNotFound)
+			case strings.HasSuffix(r.URL.Path, "/a.fail"):
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+	defer server.Close()
+
+	// The push URL is that of today, not that of the failed push.
+	r := Runner{PushURL: server.URL + "/new/{regid}/{_collector}"}
+	if err := httpInit(&r); err != nil {
+		t.Fatal(err)
+	}
+	defer httpFinish()
+	ri := newRunInfo(&r)
+	ri.state = loadState("")
+	ri.outbox = o
+	ri.coreIDData = mustCollected(t, `{"regid":"R1"}`)
+
+	// A refused or failed entry does not stop the others.
+	if !ri.replayOutbox() {
+		t.Errorf("expected the server to be fine")
+	}
+	expected := []string{"/new/R1/a.gone", "/new/R1/a.fail", "/new/R1/a.ok"}
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+	entries := o.entries()
+	if len(entries) != 1 || entries[0].Collector != "a.fail" {
+		t.Errorf("expected only a.fail to be kept, got %v", entries)
+	}
+
+	// An unreachable server stops the replay.
+	server.Close()
+	if ri.replayOutbox() {
+		t.Errorf("expected the server to be broken")
+	}
+	if len(o.entries()) != 1 {
+		t.Errorf("expected a.fail to be kept")
+	}
+}
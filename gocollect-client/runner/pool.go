@@ -0,0 +1,113 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"bytes"
+	"context"
+	golog "log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+	"github.com/ossobv/gocollect/gocollect-client/log"
+)
+
+// collectorRun is a single (possibly background) collector run.
+type collectorRun struct {
+	collectorKey string
+	startTime    time.Time
+	duration     time.Duration
+	collected    data.Collected
+	report       data.RunReport
+
+	// For background runs: the log lines are buffered until the
+	// result is picked up, so the log stays in collector order.
+	done   chan struct{}
+	logged bytes.Buffer
+}
+
+// startCollectors prepares the runs of the collectors, in order. If the
+// runner allows concurrency, the collectors (except core.id, which has
+// run already) are started in the background by a pool of workers. Call
+// wait() after cancelling the context to wait for the workers to stop.
+func (ri *runInfo) startCollectors(
+	ctx context.Context, keys []string) (runs []*collectorRun, wait func()) {
+
+	var background []*collectorRun
+	for _, collectorKey := range keys {
+		run := &collectorRun{collectorKey: collectorKey}
+		if ri.runner.Concurrency > 1 && collectorKey != "core.id" {
+			run.done = make(chan struct{})
+			background = append(background, run)
+		}
+		runs = append(runs, run)
+	}
+
+	workers := ri.runner.Concurrency
+	if workers > len(background) {
+		workers = len(background)
+	}
+
+	jobs := make(chan *collectorRun)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for run := range jobs {
+				logger := golog.New(&run.logged, "", 0)
+				ri.runCollectorRun(log.NewContext(ctx, logger), run)
+				close(run.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, run := range background {
+			select {
+			case jobs <- run:
+			case <-ri.runner.Stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return runs, wg.Wait
+}
+
+// finishCollector returns the collected data of the run. Background
+// runs are waited for and their log lines are flushed; other runs are
+// run right now.
+func (ri *runInfo) finishCollector(
+	ctx context.Context, run *collectorRun) data.Collected {
+
+	if run.done == nil {
+		ri.runCollectorRun(ctx, run)
+		return run.collected
+	}
+
+	select {
+	case <-run.done:
+	case <-ctx.Done():
+		return nil
+	}
+	if logged := strings.TrimSuffix(run.logged.String(), "\n"); logged != "" {
+		for _, line := range strings.Split(logged, "\n") {
+			log.Log.Print(line)
+		}
+	}
+	return run.collected
+}
+
+func (ri *runInfo) runCollectorRun(ctx context.Context, run *collectorRun) {
+	ri.progress("running collector " + run.collectorKey)
+	run.startTime = time.Now()
+	run.collected = ri.runCollector(
+		data.NewReportContext(ctx, &run.report), run.collectorKey)
+	run.duration = time.Since(run.startTime)
+}
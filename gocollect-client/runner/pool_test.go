@@ -0,0 +1,146 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	golog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/log"
+)
+
+// newPoolTestRunner writes the scripts (and a core.id for a registered
+// host) and returns a Runner that pushes to a test server. The pushed
+// paths are recorded in pushed.
+func newPoolTestRunner(t *testing.T, scripts map[string]string) (
+	r *Runner, pushed func() []string) {
+
+	dir, err := ioutil.TempDir("", "gocollect-pool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	scripts["core.id"] = "echo '{\"fqdn\":\"h1.example.com\",\"regid\":\"R1\"}'"
+	for name, script := range scripts {
+		err = ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte("#!/bin/sh\n"+script+"\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mutex sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			paths = append(paths, r.URL.Path)
+			mutex.Unlock()
+		}))
+	t.Cleanup(server.Close)
+
+	r = &Runner{
+		CollectorsPaths: []string{dir},
+		RegisterURL:     server.URL + "/register",
+		PushURL:         server.URL + "/push/{regid}/{_collector}",
+		RegidFilename:   filepath.Join(dir, "regid"),
+		StateFilename:   filepath.Join(dir, "state.json"),
+		Concurrency:     4,
+	}
+	return r, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func TestRunner_Run_Concurrent(t *testing.T) {
+	var buf bytes.Buffer
+	saved := log.Log
+	log.Log = golog.New(&buf, "", 0)
+	t.Cleanup(func() { log.Log = saved })
+
+	// The first ones take the longest, and they all log while the
+	// others run.
+	scripts := make(map[string]string)
+	sleeps := map[string]string{
+		"app.a": "0.4", "app.b": "0.3", "app.c": "0.2", "app.d": "0.1",
+		"app.e": "0"}
+	for key, sleep := range sleeps {
+		scripts[key] = fmt.Sprintf("echo '%s start' >&2\nsleep %s\n"+
+			"echo '%s end' >&2\necho '{\"key\":\"%s\"}'",
+			key, sleep, key, key)
+	}
+	r, pushed := newPoolTestRunner(t, scripts)
+
+	t0 := time.Now()
+	if !r.Run() {
+		t.Fatalf("run failed:\n%s", buf.String())
+	}
+	if elapsed := time.Since(t0); elapsed >= time.Second {
+		t.Errorf("expected the collectors to run concurrently, took %s",
+			elapsed)
+	}
+
+	// The pushes are in run order.
+	expected := []string{"/push/R1/core.id"}
+	for _, key := range r.Runnable()[1:] {
+		expected = append(expected, "/push/R1/"+key)
+	}
+	if got := pushed(); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("got pushes:\n%v\nexpected:\n%v", got, expected)
+	}
+
+	// And so are the log lines of the collectors.
+	var logged []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if i := strings.Index(line, ": stderr: "); i != -1 {
+			logged = append(logged, line[i+len(": stderr: "):])
+		}
+	}
+	var expectedLog []string
+	for _, key := range []string{"app.a", "app.b", "app.c", "app.d", "app.e"} {
+		expectedLog = append(expectedLog, key+" start", key+" end")
+	}
+	if strings.Join(logged, "\n") != strings.Join(expectedLog, "\n") {
+		t.Errorf("got log:\n%s\nexpected:\n%s", strings.Join(logged, "\n"),
+			strings.Join(expectedLog, "\n"))
+	}
+}
+
+func TestRunner_Run_ConcurrentStop(t *testing.T) {
+	discardLog(t)
+	scripts := map[string]string{
+		"app.a": "sleep 30", "app.b": "sleep 30", "app.c": "sleep 30",
+		"app.d": "echo '{}'", "app.e": "echo '{}'", "app.f": "echo '{}'"}
+	r, pushed := newPoolTestRunner(t, scripts)
+
+	// Stop, and abort after the grace period.
+	stop := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Stop, r.Context = stop, ctx
+	time.AfterFunc(200*time.Millisecond, func() { close(stop) })
+	time.AfterFunc(400*time.Millisecond, cancel)
+
+	t0 := time.Now()
+	if r.Run() {
+		t.Errorf("expected the run to fail")
+	}
+	if elapsed := time.Since(t0); elapsed >= 10*time.Second {
+		t.Errorf("expected the collectors to be killed, took %s", elapsed)
+	}
+	expected := []string{"/push/R1/core.id"}
+	if got := pushed(); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("got pushes %v, expected %v", got, expected)
+	}
+}
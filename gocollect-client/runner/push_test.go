@@ -0,0 +1,148 @@
+package runner
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestRunInfo_pushCollected_Conditional(t *testing.T) {
+	discardLog(t)
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			conditional := r.Header.Get("If-None-Match") != ""
+			got = append(got, strings.TrimSpace(
+				r.Method+" "+r.URL.Path+" "+string(body)))
+			switch {
+			case conditional && r.URL.Path == "/kept":
+				w.WriteHeader(http.StatusNotModified)
+			case conditional && r.URL.Path == "/refused":
+				w.WriteHeader(http.StatusPreconditionFailed)
+			case conditional && r.URL.Path == "/broken":
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+	defer server.Close()
+
+	r := Runner{PushUnchanged: PushUnchangedConditional}
+	if err := httpInit(&r); err != nil {
+		t.Fatal(err)
+	}
+	defer httpFinish()
+	ri := newRunInfo(&r)
+	ri.state = loadState("")
+	collected := mustCollected(t, `{"v":1}`)
+	hash := hashCollected(collected)
+
+	for _, key := range []string{"kept", "refused", "broken"} {
+		ri.state.setPushed(key, hash)
+		result := ri.pushCollected(key, server.URL+"/"+key, collected)
+		expected := pushStatusPushed
+		if key == "kept" {
+			expected = pushStatusUnchanged
+		}
+		if result.Status != expected {
+			t.Errorf("%s: got %s, expected %s", key, result.Status, expected)
+		}
+	}
+	expected := []string{
+		"HEAD /kept", "HEAD /refused", `POST /refused {"v":1}`,
+		"HEAD /broken", `POST /broken {"v":1}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s",
+			strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	// Only a failing connection fails the push.
+	server.Close()
+	result := ri.pushCollected("kept", server.URL+"/kept", collected)
+	if result.Status != pushStatusFailed {
+		t.Errorf("closed server: got %s", result.Status)
+	}
+}
+
+func TestRunInfo_postEncoded(t *testing.T) {
+	discardLog(t)
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			encoding := r.Header.Get("Content-Encoding")
+			var reader io.Reader = r.Body
+			switch {
+			case encoding == "":
+			case encoding == "gzip" && r.URL.Path == "/gzip":
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Errorf("bad gzip body: %s", err)
+					return
+				}
+				reader = gz
+			default:
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			body, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Errorf("bad %s body: %s", encoding, err)
+			}
+			got = append(got, strings.Join(strings.Fields(
+				r.URL.Path+" "+encoding+" "+string(body)), " "))
+		}))
+	defer server.Close()
+
+	r := Runner{PushEncoding: PushEncodingGzip}
+	if err := httpInit(&r); err != nil {
+		t.Fatal(err)
+	}
+	defer httpFinish()
+	ri := newRunInfo(&r)
+
+	// The plain server makes us stop compressing for the rest of the run.
+	body := []byte(`{"v":1}`)
+	for _, path := range []string{"/gzip", "/plain", "/gzip"} {
+		status, _, err := ri.postEncoded(
+			server.URL+path, body, http.Header{})
+		if err != nil || status != http.StatusOK {
+			t.Errorf("%s: got %d, %v", path, status, err)
+		}
+	}
+	expected := []string{
+		`/gzip gzip {"v":1}`, `/plain {"v":1}`, `/gzip {"v":1}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s",
+			strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+	if ri.pushEncoding != PushEncodingIdentity {
+		t.Errorf("expected fallback to identity, got %s", ri.pushEncoding)
+	}
+}
+
+func TestHTTPEncodeBody_Zstd(t *testing.T) {
+	body := []byte(strings.Repeat(`{"v":1}`, 100))
+	encoded, err := httpEncodeBody(PushEncodingZstd, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) >= len(body) {
+		t.Errorf("expected compressed body, got %d bytes", len(encoded))
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	decoded, err := decoder.DecodeAll(encoded, nil)
+	if err != nil || string(decoded) != string(body) {
+		t.Errorf("bad zstd body: %q, %v", decoded, err)
+	}
+}
@@ -3,6 +3,14 @@
 // server.
 package runner
 
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
 // Runner holds everything we need for gocollect action. Set all fields
 // to a valid value before calling Run().
 type Runner struct {
@@ -13,42 +21,223 @@ type Runner struct {
 	CollectorsPaths  []string
 	RegidFilename    string
 	GoCollectVersion string
+
+	// Optional TLS settings for register and push calls. Set the
+	// certificate and key for client certificate authentication. Set
+	// the CA file to verify the server against a private CA instead
+	// of the system roots. Relative paths are relative to
+	// ConfigPathBase.
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSCAFile     string
+	TLSServerName string
+
+	// Optional outbox (spool directory) for pushes that failed. They
+	// are replayed on the next run. Leave the path empty to disable.
+	OutboxPath    string
+	OutboxMaxAge  time.Duration
+	OutboxMaxSize int64
+
+	// State file where we keep track of what the server has. Together
+	// with PushUnchanged it is used to avoid pushing the same data
+	// over and over. Unchanged data is pushed in full anyway after
+	// PushFullInterval.
+	StateFilename    string
+	PushUnchanged    string
+	PushFullInterval time.Duration
+
+	// How often to run the collectors. The default RunInterval can be
+	// overridden per collector. The last run times are kept in the
+	// state file.
+	RunInterval        time.Duration
+	CollectorIntervals KeyDurations
+
+	// Maximum run time of the collectors. The default CollectorTimeout
+	// can be overridden per collector. Collectors that take too long
+	// are killed. A timeout of 0 means no limit.
+	CollectorTimeout  time.Duration
+	CollectorTimeouts KeyDurations
+
+	// Enable or disable collectors by key or glob; the last matching
+	// toggle wins. Scripts that are not executable stay disabled. The
+	// collectors get extra arguments (last match wins) and environment
+	// variables (all matches) too.
+	CollectorToggles []CollectorToggle
+	CollectorArgs    []KeyArgs
+	CollectorEnv     []KeyEnv
+
+	// Store the stderr lines of the last collector run in the state
+	// file. (They are always logged, rate limited by StderrLogLimit.)
+	KeepStderr     bool
+	StderrLogLimit data.LogLimit
+
+	// Number of collectors to run at the same time. The pushes are
+	// still done one by one, in order.
+	Concurrency int
+
+	// Optional Content-Encoding for pushed data: identity (none), gzip
+	// or zstd. If the server replies 415, we fall back to identity.
+	PushEncoding string
+
+	// Progress, if set, is called with a short description of what we
+	// are doing. It may be called from several goroutines at once.
+	Progress func(status string)
+
+	// Optional shutdown handling. Once Stop is closed, no new
+	// collectors are started. Once Context is done, the running
+	// collectors are killed and pushes are aborted.
+	Stop    <-chan struct{}
+	Context context.Context
 }
 
-// Run collects data from the collectors and pushes data to the central
+// MaxStall returns how long a run may go without progress, or 0 if
+// there is no limit because a collector may run forever.
+func (r *Runner) MaxStall() time.Duration {
+	longest := r.CollectorTimeout
+	for _, kd := range r.CollectorTimeouts {
+		if kd.Duration <= 0 {
+			return 0
+		} else if kd.Duration > longest {
+			longest = kd.Duration
+		}
+	}
+	if r.CollectorTimeout <= 0 {
+		return 0
+	}
+	// Collectors get killGrace after the timeout, and a push or
+	// register may take an httpTimeout. Add some slack.
+	return longest + httpTimeout + time.Minute
+}
+
+// Values for Runner.PushUnchanged.
+const (
+	// PushUnchangedAlways pushes all data every run. This is the
+	// default: the server may use the pushes to see that we're alive.
+	PushUnchangedAlways = "always"
+	// PushUnchangedSkip does not push data that has not changed.
+	PushUnchangedSkip = "skip"
+	// PushUnchangedConditional sends the hash of unchanged data in an
+	// If-None-Match header of a HEAD request. The server replies 304
+	// if it has the data, or anything else if it wants it.
+	PushUnchangedConditional = "conditional"
+)
+
+// Placeholders in the PushURL that the runner fills in, next to the
+// values of the core.id collector.
+const (
+	// PlaceholderCollector is the key of the collector being pushed.
+	PlaceholderCollector = "_collector"
+	// PlaceholderVersion is the GoCollectVersion.
+	PlaceholderVersion = "gocollect"
+	// PlaceholderAPIKey is the APIKey, if set.
+	PlaceholderAPIKey = "gocollect-apikey"
+)
+
+// Values for Runner.PushEncoding.
+const (
+	// PushEncodingIdentity sends plain JSON.
+	PushEncodingIdentity = "identity"
+	// PushEncodingGzip sends gzip compressed JSON.
+	PushEncodingGzip = "gzip"
+	// PushEncodingZstd sends zstd compressed JSON.
+	PushEncodingZstd = "zstd"
+)
+
+// Run collects data from all collectors and pushes data to the central
 // server. If needed, it registers first.
 func (r *Runner) Run() bool {
-	runner := newRunInfo(r)
+	return r.run(nil)
+}
 
-	// Initialize HTTP calls.
-	httpInit()
-	defer httpFinish()
+// RunDue is like Run, but only runs the collectors that are due
+// according to their run interval.
+func (r *Runner) RunDue() bool {
+	now := time.Now()
+	return r.run(func(ri *runInfo, collectorKey string) bool {
+		return ri.isDue(collectorKey, now)
+	})
+}
 
-	// Fetch the core info -- which also fetches the regid.
-	if !runner.setCoreIDData() {
+// RunCollectors is like Run, but only runs the listed collectors.
+func (r *Runner) RunCollectors(collectorKeys []string) bool {
+	return r.run(func(ri *runInfo, collectorKey string) bool {
+		for _, key := range collectorKeys {
+			if key == collectorKey {
+				return true
+			}
+		}
 		return false
-	}
+	})
+}
 
-	// Check if we need to register first.
-	if runner.needsRegister() {
-		if !runner.runRegister() {
-			return false
-		}
-	}
+// Runnable returns the keys of all enabled collectors, in run order.
+func (r *Runner) Runnable() []string {
+	runner := newRunInfo(r)
+	return runner.collectors.GetRunnable()
+}
 
-	// Then run all collectors.
-	if (runner.runAll() != runSuccess) {
-		return false
+// NextRun returns the time when the next collector is due.
+func (r *Runner) NextRun() time.Time {
+	runner := newRunInfo(r)
+	runner.state = loadState(r.StateFilename)
+	return runner.nextRun()
+}
+
+// SetNextRun records when the daemon wakes up for the next run, for
+// the status.
+func (r *Runner) SetNextRun(t time.Time) {
+	updateState(r.StateFilename, func(state *runState) {
+		state.NextRun = t
+	})
+}
+
+func (r *Runner) run(selected collectorFilter) bool {
+	runner := newRunInfo(r)
+
+	// Load what we know from previous runs; store the results of this
+	// run when we're done.
+	runner.state = loadState(r.StateFilename)
+	runner.summary = &runSummary{Started: time.Now()}
+	ret := runner.run(selected)
+
+	runner.summary.Duration = time.Since(runner.summary.Started).Seconds()
+	runner.summary.Result = "ok"
+	if runner.isStopping() {
+		runner.summary.Result = "stopped"
+	} else if !ret {
+		runner.summary.Result = "failed"
 	}
-	return true
+	metricRuns.Add(1, runner.summary.Result)
+	metricRunDuration.Set(runner.summary.Duration)
+	runner.state.LastRun = runner.summary
+	runner.state.saveChanges(r.StateFilename)
+	return ret
 }
 
 // Get collects data from a single collector and returns it as a string.
 func (r *Runner) Get(collectorKey string) string {
 	runner := newRunInfo(r)
-	collected := runner.runCollector(collectorKey)
+	collected := runner.runCollector(runner.ctx, collectorKey)
 	if collected == nil {
 		return ""
 	}
 	return collected.String()
 }
+
+// Register registers the host at the register URL, unless it has a
+// regid already, and returns the regid.
+func (r *Runner) Register() (string, error) {
+	if err := httpInit(r); err != nil {
+		return "", err
+	}
+	defer httpFinish()
+
+	runner := newRunInfo(r)
+	if !runner.setCoreIDData() {
+		return "", errors.New("collector core.id failed")
+	}
+	if runner.needsRegister() && !runner.runRegister() {
+		return "", errors.New("register failed")
+	}
+	return runner.coreIDData.GetString("regid"), nil
+}
@@ -0,0 +1,89 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// KeyDuration holds a duration for the collectors matching the pattern.
+// The pattern is a collector key or a glob like "app.*".
+type KeyDuration struct {
+	Pattern  string
+	Duration time.Duration
+}
+
+// KeyDurations is a list of per-collector durations. Like in the
+// config file, the *last* match wins.
+type KeyDurations []KeyDuration
+
+// Get returns the duration for the collector, or defaultValue if no
+// pattern matches.
+func (kds KeyDurations) Get(
+	collectorKey string, defaultValue time.Duration) time.Duration {
+
+	for i := len(kds) - 1; i >= 0; i-- {
+		if ok, _ := filepath.Match(kds[i].Pattern, collectorKey); ok {
+			return kds[i].Duration
+		}
+	}
+	return defaultValue
+}
+
+// Collectors that are due within this time are run together with the
+// ones that are due now, so we don't wake up again moments later.
+const scheduleSlack = time.Minute
+
+// A collector that collected nothing is retried after this time,
+// doubling for every consecutive failure, up to its run interval.
+const failureRetry = 5 * time.Minute
+
+// dueAt returns the time when the collector should run next.
+func (ri *runInfo) dueAt(collectorKey string) time.Time {
+	cs, ok := ri.state.Collectors[collectorKey]
+	if !ok {
+		return time.Time{}
+	}
+	interval := ri.runner.CollectorIntervals.Get(
+		collectorKey, ri.runner.RunInterval)
+	if cs.Failures > 0 {
+		return cs.Started.Add(retryDelay(cs.Failures, interval))
+	} else if cs.LastRun.IsZero() {
+		return time.Time{}
+	}
+	return cs.LastRun.Add(interval)
+}
+
+// retryDelay returns the backoff after the given number of failures.
+func retryDelay(failures int, interval time.Duration) time.Duration {
+	delay := failureRetry
+	for i := 1; i < failures && delay < interval; i++ {
+		delay *= 2
+	}
+	if delay > interval {
+		return interval
+	}
+	return delay
+}
+
+// isDue returns true if the collector should run now.
+func (ri *runInfo) isDue(collectorKey string, now time.Time) bool {
+	return ri.dueAt(collectorKey).Before(now.Add(scheduleSlack))
+}
+
+// nextRun returns the time when the first collector is due.
+func (ri *runInfo) nextRun() (next time.Time) {
+	runnable := ri.collectors.GetRunnable()
+	if len(runnable) == 0 {
+		return time.Now().Add(ri.runner.RunInterval)
+	}
+	for i, collectorKey := range runnable {
+		due := ri.dueAt(collectorKey)
+		if i == 0 || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
@@ -0,0 +1,140 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
+func TestKeyDurations_Get(t *testing.T) {
+	kds := KeyDurations{
+		{"os.*", time.Hour},
+		{"app.lshw", 24 * time.Hour},
+		{"os.pkg", 4 * time.Hour},
+	}
+	type inout struct {
+		in  string
+		out time.Duration
+	}
+	list := []inout{
+		{"os.uptime", time.Hour},
+		{"os.pkg", 4 * time.Hour}, // last match wins
+		{"app.lshw", 24 * time.Hour},
+		{"sys.cpu", time.Minute}, // default
+	}
+	for i, item := range list {
+		actual := kds.Get(item.in, time.Minute)
+		if actual != item.out {
+			t.Errorf("#%d: Get(%q) returned %s, expected %s",
+				i, item.in, actual, item.out)
+		}
+	}
+}
+
+func newScheduleRunInfo(keys ...string) *runInfo {
+	collectors := data.Collectors{}
+	for _, key := range keys {
+		collectors[key] = data.Collector{IsEnabled: true}
+	}
+	return &runInfo{
+		runner: &Runner{
+			RunInterval:        4 * time.Hour,
+			CollectorIntervals: KeyDurations{{"os.uptime", time.Hour}},
+		},
+		collectors: &collectors,
+		state:      loadState(""),
+	}
+}
+
+func TestRunInfo_dueAt(t *testing.T) {
+	ri := newScheduleRunInfo("os.pkg", "os.uptime", "app.broken")
+	then := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if due := ri.dueAt("os.pkg"); !due.IsZero() {
+		t.Errorf("never ran: got %s, expected zero time", due)
+	}
+	ri.state.setRun("os.pkg", then)
+	ri.state.setRun("os.uptime", then)
+	if due := ri.dueAt("os.pkg"); !due.Equal(then.Add(4 * time.Hour)) {
+		t.Errorf("os.pkg: got %s, expected run interval", due)
+	}
+	if due := ri.dueAt("os.uptime"); !due.Equal(then.Add(time.Hour)) {
+		t.Errorf("os.uptime: got %s, expected collector interval", due)
+	}
+
+	// A collector that never delivers backs off, up to its interval.
+	expected := []time.Duration{
+		5 * time.Minute, 10 * time.Minute, 20 * time.Minute,
+		40 * time.Minute, 80 * time.Minute, 160 * time.Minute,
+		4 * time.Hour, 4 * time.Hour,
+	}
+	for i, delay := range expected {
+		ri.state.setRunResult(&collectorRun{
+			collectorKey: "app.broken", startTime: then})
+		if due := ri.dueAt("app.broken"); !due.Equal(then.Add(delay)) {
+			t.Errorf("failure #%d: got %s, expected %s",
+				i+1, due.Sub(then), delay)
+		}
+	}
+
+	// Collecting something again resets the backoff.
+	ri.state.setRunResult(&collectorRun{
+		collectorKey: "app.broken", startTime: then,
+		collected: mustCollected(t, `{}`)})
+	ri.state.setRun("app.broken", then)
+	if due := ri.dueAt("app.broken"); !due.Equal(then.Add(4 * time.Hour)) {
+		t.Errorf("recovered: got %s, expected run interval", due.Sub(then))
+	}
+}
+
+func TestRunInfo_isDue(t *testing.T) {
+	ri := newScheduleRunInfo("os.pkg")
+	now := time.Now()
+
+	if !ri.isDue("os.pkg", now) {
+		t.Errorf("never ran: expected due")
+	}
+	ri.state.setRun("os.pkg", now.Add(-4*time.Hour))
+	if !ri.isDue("os.pkg", now) {
+		t.Errorf("interval passed: expected due")
+	}
+	ri.state.setRun("os.pkg", now.Add(-4*time.Hour+scheduleSlack/2))
+	if !ri.isDue("os.pkg", now) {
+		t.Errorf("due within the slack: expected due")
+	}
+	ri.state.setRun("os.pkg", now.Add(-time.Hour))
+	if ri.isDue("os.pkg", now) {
+		t.Errorf("ran an hour ago: expected not due")
+	}
+	ri.state.setRunResult(&collectorRun{
+		collectorKey: "os.pkg", startTime: now.Add(-time.Minute)})
+	if ri.isDue("os.pkg", now) {
+		t.Errorf("failed a minute ago: expected not due")
+	}
+}
+
+func TestRunInfo_nextRun(t *testing.T) {
+	now := time.Now()
+	ri := newScheduleRunInfo()
+	if next := ri.nextRun(); next.Before(now.Add(4 * time.Hour)) {
+		t.Errorf("no collectors: got %s, expected a run interval", next)
+	}
+
+	ri = newScheduleRunInfo("os.pkg", "os.uptime", "app.broken")
+	ri.state.setRun("os.pkg", now)
+	ri.state.setRun("os.uptime", now)
+	ri.state.setRun("app.broken", now)
+	if next := ri.nextRun(); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("got %s, expected os.uptime", next.Sub(now))
+	}
+	ri.state.setRunResult(&collectorRun{
+		collectorKey: "app.broken", startTime: now})
+	if next := ri.nextRun(); !next.Equal(now.Add(failureRetry)) {
+		t.Errorf("got %s, expected the app.broken retry", next.Sub(now))
+	}
+	delete(ri.state.Collectors, "os.pkg")
+	if next := ri.nextRun(); !next.IsZero() {
+		t.Errorf("got %s, expected zero time for os.pkg", next)
+	}
+}
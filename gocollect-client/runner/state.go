@@ -0,0 +1,238 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+	"github.com/ossobv/gocollect/gocollect-client/log"
+)
+
+// runState is what we remember between runs. It is stored as JSON in
+// the state file.
+type runState struct {
+	// Result of the last run.
+	LastRun *runSummary `json:"last_run,omitempty"`
+	// When the daemon wakes up for the next run.
+	NextRun time.Time `json:"next_run,omitempty"`
+
+	Collectors map[string]*collectorState `json:"collectors"`
+
+	// The collectors that were touched since loading.
+	changed map[string]bool
+}
+
+// stateMutex serialises the updates of the state file. Runs (from the
+// main loop or the control socket) and SetNextRun load, modify and save
+// it concurrently.
+var stateMutex sync.Mutex
+
+// runSummary describes a complete run.
+type runSummary struct {
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration"`
+	// Either "ok", "failed" or "stopped".
+	Result string `json:"result"`
+	// The number of collectors that ran, and how many of those failed.
+	Collectors int `json:"collectors"`
+	Failed     int `json:"failed"`
+}
+
+// collectorState holds the state of a single collector.
+type collectorState struct {
+	// Hash of the data that the server has.
+	Hash string `json:"hash,omitempty"`
+	// Time of the last full push.
+	PushedAt time.Time `json:"pushed_at,omitempty"`
+	// Time of the last run that got delivered (pushed or stored in
+	// the outbox). Used for scheduling.
+	LastRun time.Time `json:"last_run,omitempty"`
+	// Consecutive runs that collected nothing. Used to back off.
+	Failures int `json:"failures,omitempty"`
+	// Stderr output of the last run, if Runner.KeepStderr is set.
+	Stderr []string `json:"stderr,omitempty"`
+
+	// The last run: start time, duration in seconds and outcome. The
+	// outcome is "ok", "error" (no data) or the failure reason (exit,
+	// signal, decode, timeout or exec).
+	Started  time.Time `json:"started,omitempty"`
+	Duration float64   `json:"duration,omitempty"`
+	Outcome  string    `json:"outcome,omitempty"`
+	// Hash and size of the data collected during the last run.
+	OutputHash string `json:"output_hash,omitempty"`
+	OutputSize int    `json:"output_size,omitempty"`
+	// The last push (attempt).
+	Push *pushResult `json:"push,omitempty"`
+}
+
+// Push statuses.
+const (
+	pushStatusPushed    = "pushed"
+	pushStatusUnchanged = "unchanged"
+	pushStatusEmpty     = "empty"
+	pushStatusOutbox    = "outbox"
+	pushStatusFailed    = "failed"
+)
+
+// Maximum length of the server reply stored in the state.
+const maxPushReply = 512
+
+// pushResult is the outcome of a push.
+type pushResult struct {
+	Status string `json:"status"`
+	// HTTP status code, if we got that far.
+	Code int `json:"code,omitempty"`
+	// The server reply or error message (truncated).
+	Reply string `json:"reply,omitempty"`
+}
+
+func (p pushResult) ok() bool {
+	return p.Status != pushStatusFailed
+}
+
+func newPushResult(status string, code int, reply string) pushResult {
+	if len(reply) > maxPushReply {
+		reply = reply[:maxPushReply] + "..."
+	}
+	return pushResult{Status: status, Code: code, Reply: reply}
+}
+
+// loadState reads the state file. A missing or broken state file
+// yields an empty state; we'll simply push everything again.
+func loadState(filename string) *runState {
+	state := &runState{}
+	if filename != "" {
+		encoded, err := ioutil.ReadFile(filename)
+		if err == nil {
+			err = json.Unmarshal(encoded, state)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Log.Printf("state[%s]: ignoring: %s", filename, err)
+			state = &runState{}
+		}
+	}
+	if state.Collectors == nil {
+		state.Collectors = make(map[string]*collectorState)
+	}
+	return state
+}
+
+// save atomically writes the state file.
+func (s *runState) save(filename string) {
+	if filename == "" {
+		return
+	}
+	encoded, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		err = writeFileAtomic(filename, append(encoded, '\n'), 0600)
+	}
+	if err != nil {
+		log.Log.Printf("state[%s]: save failed: %s", filename, err)
+	}
+}
+
+// updateState loads the state file, calls update and saves the result,
+// all while holding the stateMutex.
+func updateState(filename string, update func(state *runState)) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	state := loadState(filename)
+	update(state)
+	state.save(filename)
+}
+
+// saveChanges saves the collectors that were touched and the last run
+// summary on top of the current state file. Other updates that were
+// saved since this state was loaded are kept.
+func (s *runState) saveChanges(filename string) {
+	updateState(filename, func(current *runState) {
+		for collectorKey := range s.changed {
+			current.Collectors[collectorKey] = s.Collectors[collectorKey]
+		}
+		if s.LastRun != nil {
+			current.LastRun = s.LastRun
+		}
+	})
+}
+
+// get returns the (mutable) state of the collector.
+func (s *runState) get(collectorKey string) *collectorState {
+	cs, ok := s.Collectors[collectorKey]
+	if !ok {
+		cs = &collectorState{}
+		s.Collectors[collectorKey] = cs
+	}
+	if s.changed == nil {
+		s.changed = make(map[string]bool)
+	}
+	s.changed[collectorKey] = true
+	return cs
+}
+
+// isUnchanged returns true if the server already has the data with
+// this hash, and the last full push is less than maxAge ago.
+func (s *runState) isUnchanged(
+	collectorKey string, hash string, maxAge time.Duration) bool {
+
+	cs, ok := s.Collectors[collectorKey]
+	if !ok || cs.Hash != hash {
+		return false
+	}
+	return maxAge <= 0 || time.Since(cs.PushedAt) < maxAge
+}
+
+// setPushed records a successful full push.
+func (s *runState) setPushed(collectorKey string, hash string) {
+	cs := s.get(collectorKey)
+	cs.Hash = hash
+	cs.PushedAt = time.Now()
+}
+
+// setRun records that the collector ran (at start time t) and that its
+// data was delivered.
+func (s *runState) setRun(collectorKey string, t time.Time) {
+	s.get(collectorKey).LastRun = t
+}
+
+// setRunResult records the details of the last collector run.
+func (s *runState) setRunResult(run *collectorRun) {
+	cs := s.get(run.collectorKey)
+	cs.Started = run.startTime
+	cs.Duration = run.duration.Seconds()
+	cs.OutputHash = ""
+	cs.OutputSize = 0
+	switch {
+	case run.collected == nil:
+		cs.Outcome = "error"
+		cs.Failures++
+		return
+	case run.report.Failure != "":
+		cs.Outcome = run.report.Failure
+	default:
+		cs.Outcome = "ok"
+	}
+	cs.Failures = 0
+	cs.OutputHash = hashCollected(run.collected)
+	cs.OutputSize = len(run.collected.String())
+}
+
+// setPushResult records the outcome of the last push.
+func (s *runState) setPushResult(collectorKey string, result pushResult) {
+	s.get(collectorKey).Push = &result
+}
+
+// hashCollected returns the content hash of the collected data.
+func hashCollected(collected data.Collected) string {
+	sum := sha256.Sum256([]byte(collected.String()))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,106 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStateFile(t *testing.T) string {
+	discardLog(t)
+	path, err := ioutil.TempDir("", "gocollect-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	return filepath.Join(path, "state.json")
+}
+
+func TestLoadState(t *testing.T) {
+	filename := newTestStateFile(t)
+	if s := loadState(filename); s.Collectors == nil || s.LastRun != nil {
+		t.Errorf("missing file: expected an empty state, got %+v", s)
+	}
+
+	s := loadState(filename)
+	s.setRun("os.pkg", time.Unix(1500000000, 0))
+	s.save(filename)
+	if st, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	} else if st.Mode().Perm() != 0600 {
+		t.Errorf("got mode %o, expected 0600", st.Mode().Perm())
+	}
+	s = loadState(filename)
+	if cs, ok := s.Collectors["os.pkg"]; !ok || cs.LastRun.Unix() != 1500000000 {
+		t.Errorf("os.pkg not restored: %+v", s.Collectors)
+	}
+
+	ioutil.WriteFile(filename, []byte("{broken"), 0600)
+	if s := loadState(filename); len(s.Collectors) != 0 {
+		t.Errorf("broken file: expected an empty state, got %+v", s)
+	}
+}
+
+func TestRunState_saveChanges(t *testing.T) {
+	filename := newTestStateFile(t)
+	then := time.Unix(1500000000, 0)
+	updateState(filename, func(s *runState) {
+		s.setRun("os.pkg", then)
+		s.setRun("os.uptime", then)
+	})
+
+	// A run loads the state, and meanwhile others update it.
+	s := loadState(filename)
+	s.setRun("os.pkg", then.Add(time.Hour))
+	s.LastRun = &runSummary{Started: then.Add(time.Hour), Result: "ok"}
+	updateState(filename, func(s *runState) {
+		s.NextRun = then.Add(2 * time.Hour)
+		s.setRun("os.uptime", then.Add(time.Minute))
+	})
+	s.saveChanges(filename)
+
+	s = loadState(filename)
+	if !s.NextRun.Equal(then.Add(2 * time.Hour)) {
+		t.Errorf("NextRun was overwritten: %s", s.NextRun)
+	}
+	if !s.Collectors["os.uptime"].LastRun.Equal(then.Add(time.Minute)) {
+		t.Errorf("os.uptime was overwritten: %s", s.Collectors["os.uptime"].LastRun)
+	}
+	if !s.Collectors["os.pkg"].LastRun.Equal(then.Add(time.Hour)) {
+		t.Errorf("os.pkg was not saved: %s", s.Collectors["os.pkg"].LastRun)
+	}
+	if s.LastRun == nil || s.LastRun.Result != "ok" {
+		t.Errorf("LastRun was not saved: %+v", s.LastRun)
+	}
+}
+
+func TestRunState_isUnchanged(t *testing.T) {
+	s := loadState("")
+	hash := hashCollected(mustCollected(t, `{"a":1,"b":2}`))
+	if hash != hashCollected(mustCollected(t, `{"a":1,"b":2}`)) {
+		t.Errorf("hash is not stable")
+	}
+	if hash == hashCollected(mustCollected(t, `{"a":1,"b":3}`)) {
+		t.Errorf("hash does not depend on the values")
+	}
+
+	if s.isUnchanged("app.x", hash, 0) {
+		t.Errorf("unchanged before the first push")
+	}
+	s.setPushed("app.x", hash)
+	if !s.isUnchanged("app.x", hash, 0) {
+		t.Errorf("changed after the push")
+	}
+	if !s.isUnchanged("app.x", hash, time.Hour) {
+		t.Errorf("changed within the full push interval")
+	}
+	if s.isUnchanged("app.x", "other", 0) {
+		t.Errorf("unchanged with another hash")
+	}
+	s.Collectors["app.x"].PushedAt = time.Now().Add(-2 * time.Hour)
+	if s.isUnchanged("app.x", hash, time.Hour) {
+		t.Errorf("unchanged after the full push interval")
+	}
+}
@@ -0,0 +1,73 @@
+// Package runner (gocollect) is the core of the GoCollect daemon. The
+// Run() method will do the collecting and submitting to the central
+// server.
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// WriteStatus writes a human readable summary of the state file: the
+// last run, the next run and the results per collector.
+func (r *Runner) WriteStatus(w io.Writer) error {
+	if _, err := os.Stat(r.StateFilename); err != nil {
+		return err
+	}
+	state := loadState(r.StateFilename)
+
+	if last := state.LastRun; last != nil {
+		fmt.Fprintf(w, "last run: %s (%s, %d collectors, %d failed, %s)\n",
+			formatStatusTime(last.Started), last.Result, last.Collectors,
+			last.Failed, formatStatusDuration(last.Duration))
+	} else {
+		fmt.Fprintf(w, "last run: -\n")
+	}
+	fmt.Fprintf(w, "next run: %s\n\n", formatStatusTime(state.NextRun))
+
+	keys := make([]string, 0, len(state.Collectors))
+	for key := range state.Collectors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "COLLECTOR\tLAST RUN\tDURATION\tOUTCOME\tSIZE\tPUSH\n")
+	for _, key := range keys {
+		cs := state.Collectors[key]
+		push := "-"
+		if cs.Push != nil {
+			push = cs.Push.Status
+			if cs.Push.Code != 0 {
+				push += fmt.Sprintf(" (%d)", cs.Push.Code)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			key, formatStatusTime(cs.Started),
+			formatStatusDuration(cs.Duration), statusOrDash(cs.Outcome),
+			cs.OutputSize, push)
+	}
+	return tw.Flush()
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func formatStatusDuration(seconds float64) string {
+	return fmt.Sprintf("%.1fs", seconds)
+}
+
+func statusOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package runner
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunner_WriteStatus(t *testing.T) {
+	r := Runner{StateFilename: newTestStateFile(t)}
+	var buf bytes.Buffer
+	if err := r.WriteStatus(&buf); !os.IsNotExist(err) {
+		t.Errorf("missing state file: got %v, expected not exist", err)
+	}
+
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	updateState(r.StateFilename, func(s *runState) {
+		s.LastRun = &runSummary{
+			Started: started, Duration: 12.34, Result: "failed",
+			Collectors: 2, Failed: 1}
+		s.NextRun = started.Add(time.Hour)
+		cs := s.get("os.pkg")
+		cs.Started, cs.Duration, cs.Outcome = started, 1.5, "ok"
+		cs.OutputSize = 42
+		cs.Push = &pushResult{Status: pushStatusPushed, Code: 200}
+		s.get("app.broken").Outcome = "exit"
+	})
+	if err := r.WriteStatus(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"last run: 2020-01-02 03:04:05 (failed, 2 collectors, 1 failed, 12.3s)",
+		"next run: 2020-01-02 04:04:05",
+		"",
+		"COLLECTOR   LAST RUN             DURATION  OUTCOME  SIZE  PUSH",
+		"app.broken  -                    0.0s      exit     0     -",
+		"os.pkg      2020-01-02 03:04:05  1.5s      ok       42    pushed (200)",
+		"",
+	}
+	if buf.String() != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s",
+			buf.String(), strings.Join(expected, "\n"))
+	}
+}
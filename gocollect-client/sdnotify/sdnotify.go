@@ -0,0 +1,66 @@
+// Package sdnotify (gocollect) implements the systemd notify protocol,
+// see sd_notify(3). Messages are sent as datagrams to the socket in
+// $NOTIFY_SOCKET. Without that variable, nothing is sent.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends the state (one or more newline separated VAR=VALUE
+// assignments) to the service manager.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// Go maps a leading '@' to the abstract namespace for us.
+	conn, err := net.DialUnix(
+		"unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready tells the service manager that startup is finished.
+func Ready() error {
+	return Notify("READY=1")
+}
+
+// Stopping tells the service manager that we're shutting down.
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// Status sets the free-form status shown by systemctl status.
+func Status(format string, args ...interface{}) error {
+	return Notify("STATUS=" + fmt.Sprintf(format, args...))
+}
+
+// Watchdog pings the service manager watchdog.
+func Watchdog() error {
+	return Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the watchdog timeout configured by the
+// service manager (WatchdogSec=), or 0 if the watchdog is not enabled
+// for this process. Ping at least twice per interval.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		if pid != strconv.Itoa(os.Getpid()) {
+			return 0
+		}
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,117 @@
+// Package shcollectors (gocollect) makes shell-script plugins available
+// for collection.
+package shcollectors
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout is the default maximum run time of a collector
+// (collectors_timeout).
+const DefaultTimeout = 180 * time.Second
+
+// killGrace is the time a collector gets to exit after the TERM signal,
+// before it is sent a KILL. (A variable for the tests.)
+var killGrace = 5 * time.Second
+
+// errTimedOut is returned by runCommand when the collector was killed
+// because it ran too long.
+var errTimedOut = errors.New("timed out")
+
+// runCommand runs the command in its own process group. When the
+// context expires, the entire group is sent TERM, and KILL if it's
+// still around after killGrace. If the context was cancelled (instead
+// of timing out), context.Canceled is returned. Without a deadline, the
+// command may run forever.
+//
+// The output is copied to cmd.Stdout and cmd.Stderr by us instead of
+// by exec: a child that escaped the process group may keep it open
+// forever. When runCommand returns, the copying has stopped.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	var readers, writers []*os.File
+	var outputs []io.Writer
+	closeAll := func(files []*os.File) {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	for _, output := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		if *output == nil {
+			continue
+		}
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			closeAll(readers)
+			closeAll(writers)
+			return err
+		}
+		readers = append(readers, reader)
+		writers = append(writers, writer)
+		outputs = append(outputs, *output)
+		*output = writer
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	closeAll(writers) // the child has its own copies
+	if err != nil {
+		closeAll(readers)
+		return err
+	}
+
+	var copies sync.WaitGroup
+	for i, reader := range readers {
+		copies.Add(1)
+		go func(output io.Writer, reader *os.File) {
+			defer copies.Done()
+			io.Copy(output, reader)
+		}(outputs[i], reader)
+	}
+	// Closing the readers stops the copying, if the output is still
+	// open when we give up.
+	defer func() {
+		closeAll(readers)
+		copies.Wait()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		copies.Wait()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Kill the process group; the pgid is the pid of the leader.
+	killed := errTimedOut
+	if ctx.Err() == context.Canceled {
+		killed = context.Canceled
+	}
+	pgid := cmd.Process.Pid
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case <-done:
+		return killed
+	case <-time.After(killGrace):
+	}
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	select {
+	case <-done:
+	case <-time.After(killGrace):
+		// A child that escaped the process group is keeping the
+		// output open. Leave it be; we have waited long enough.
+	}
+	return killed
+}
@@ -0,0 +1,70 @@
+// Package shcollectors (gocollect) makes shell-script plugins available
+// for collection.
+package shcollectors
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRunCommand_Timeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The background sleep keeps stdout open; it must be killed too.
+	cmd := exec.Command("/bin/sh", "-c", "sleep 30 & sleep 30")
+	cmd.Stdout = &testWriter{}
+	t0 := time.Now()
+	err := runCommand(ctx, cmd)
+	if err != errTimedOut {
+		t.Fatalf("expected errTimedOut, got %v", err)
+	}
+	if elapsed := time.Since(t0); elapsed >= killGrace {
+		t.Errorf("expected TERM to suffice, took %s", elapsed)
+	}
+}
+
+func TestRunCommand_NoTimeout(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	err := runCommand(context.Background(), cmd)
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Success() {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+}
+
+func TestRunCommand_EscapedChild(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("no setsid")
+	}
+	saved := killGrace
+	killGrace = 100 * time.Millisecond
+	defer func() { killGrace = saved }()
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The background loop runs in its own session, out of reach of the
+	// kill, and keeps writing to stdout after we give up.
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", ("setsid /bin/sh -c " +
+		"'for i in 1 2 3 4 5 6 7 8 9 10; do echo x; sleep 0.1; done' &"))
+	cmd.Stdout = &stdout
+	if err := runCommand(ctx, cmd); err != errTimedOut {
+		t.Fatalf("expected errTimedOut, got %v", err)
+	}
+	size := stdout.Len()
+	time.Sleep(300 * time.Millisecond)
+	if stdout.Len() != size {
+		t.Errorf("stdout written to after return")
+	}
+}
+
+type testWriter struct{}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,179 @@
+// Package shcollectors (gocollect) makes shell-script plugins available
+// for collection.
+package shcollectors
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
+// Bounds for the output included in failure reports.
+const (
+	maxStderrTail    = 2048
+	maxStdoutExcerpt = 1024
+)
+
+// failure is the report that is pushed instead of the collector data
+// if the collector fails. The schema is documented in gocollect(8)
+// under COLLECTOR ERRORS. The "error" key is kept compatible with the
+// old {"error":"EINVAL"} report.
+type failure struct {
+	// EINVAL (bad exit or bad output), ETIMEDOUT (killed) or the errno
+	// name of the exec failure (ENOENT, EACCES, ENOEXEC, ...).
+	Error string `json:"error"`
+	// One of: exit, signal, decode, timeout, exec.
+	Reason   string  `json:"reason"`
+	Script   string  `json:"script"`
+	Duration float64 `json:"duration"`
+
+	ExitStatus    *int   `json:"exit_status,omitempty"`
+	Signal        string `json:"signal,omitempty"`
+	Message       string `json:"message,omitempty"`
+	DecodeOffset  *int64 `json:"decode_offset,omitempty"`
+	StderrTail    string `json:"stderr_tail,omitempty"`
+	StdoutExcerpt string `json:"stdout_excerpt,omitempty"`
+}
+
+// newFailure creates a failure report from the runCommand error. Pass
+// a nil error for collectors that exited cleanly with bad output.
+func newFailure(execpath string, duration time.Duration, err error,
+	stdout []byte, stderr []byte) *failure {
+
+	f := &failure{
+		Error:      "EINVAL",
+		Script:     execpath,
+		Duration:   duration.Seconds(),
+		StderrTail: string(stderr),
+	}
+
+	switch e := err.(type) {
+	case nil:
+		f.setDecodeError(stdout)
+	case *exec.ExitError:
+		f.StdoutExcerpt = excerpt(stdout, 0)
+		status, _ := e.Sys().(syscall.WaitStatus)
+		if status.Signaled() {
+			f.Reason = "signal"
+			f.Signal = status.Signal().String()
+		} else {
+			exitStatus := status.ExitStatus()
+			f.Reason = "exit"
+			f.ExitStatus = &exitStatus
+		}
+	default:
+		if err == errTimedOut {
+			f.Error = "ETIMEDOUT"
+			f.Reason = "timeout"
+			f.StdoutExcerpt = excerpt(stdout, 0)
+		} else {
+			f.Reason = "exec"
+			f.Message = err.Error()
+			if errno, ok := unwrapErrno(err); ok {
+				f.Error = errnoName(errno)
+			}
+		}
+	}
+	return f
+}
+
+// setDecodeError fills in why the output is not valid JSON.
+func (f *failure) setDecodeError(stdout []byte) {
+	f.Reason = "decode"
+	_, err := data.NewCollected(stdout)
+	if err == nil {
+		return
+	}
+	f.Message = err.Error()
+	var offset int64
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		offset = syntaxErr.Offset
+		f.DecodeOffset = &offset
+	}
+	f.StdoutExcerpt = excerpt(stdout, int(offset))
+}
+
+// collected returns the report as collected data.
+func (f *failure) collected() data.Collected {
+	encoded, _ := json.Marshal(f) // invalid utf-8 is replaced
+	ret, _ := data.NewCollected(encoded)
+	return ret
+}
+
+// excerpt returns at most maxStdoutExcerpt bytes of output, around the
+// offset.
+func excerpt(output []byte, offset int) string {
+	start := offset - maxStdoutExcerpt/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + maxStdoutExcerpt
+	if end > len(output) {
+		end = len(output)
+	}
+	if start > end {
+		start = end
+	}
+	return string(output[start:end])
+}
+
+// unwrapErrno finds the errno in exec/os errors.
+func unwrapErrno(err error) (syscall.Errno, bool) {
+	for {
+		switch e := err.(type) {
+		case syscall.Errno:
+			return e, true
+		case *exec.Error:
+			err = e.Err
+		case *os.PathError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			if err == exec.ErrNotFound {
+				return syscall.ENOENT, true
+			}
+			return 0, false
+		}
+	}
+}
+
+func errnoName(errno syscall.Errno) string {
+	switch errno {
+	case syscall.ENOENT:
+		return "ENOENT"
+	case syscall.EACCES:
+		return "EACCES"
+	case syscall.ENOEXEC:
+		return "ENOEXEC"
+	case syscall.EPERM:
+		return "EPERM"
+	}
+	return "EINVAL"
+}
+
+// tailBuffer is an io.Writer that keeps only the last max bytes.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > 2*t.max {
+		t.buf = append([]byte(nil), t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns the last max bytes written.
+func (t *tailBuffer) Bytes() []byte {
+	if len(t.buf) > t.max {
+		return t.buf[len(t.buf)-t.max:]
+	}
+	return t.buf
+}
@@ -0,0 +1,118 @@
+// Package shcollectors (gocollect) makes shell-script plugins available
+// for collection.
+package shcollectors
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
+func runTestScript(t *testing.T, script string) map[string]interface{} {
+	return runTestScriptWith(t, script, data.Settings{})
+}
+
+func runTestScriptWith(t *testing.T, script string,
+	settings data.Settings) map[string]interface{} {
+
+	discardLog(t)
+	dir, err := ioutil.TempDir("", "gocollect-failure-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	execpath := filepath.Join(dir, "test.collector")
+	if script != "" {
+		ioutil.WriteFile(execpath, []byte(script), 0755)
+	}
+
+	collected := runShellCollector(
+		context.Background(), "test.collector", execpath, settings)
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(collected.String()), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["script"] != nil && decoded["script"] != execpath {
+		t.Errorf("unexpected script %v", decoded["script"])
+	}
+	return decoded
+}
+
+func TestRunShellCollector_Settings(t *testing.T) {
+	decoded := runTestScriptWith(t,
+		"#!/bin/sh\nprintf '{\"args\":\"%s\",\"foo\":\"%s\"}' \"$*\" \"$FOO\"\n",
+		data.Settings{Args: []string{"-a", "-b"}, Env: []string{"FOO=bar"}})
+	if decoded["args"] != "-a -b" || decoded["foo"] != "bar" {
+		t.Errorf("unexpected %v", decoded)
+	}
+}
+
+func TestFailure_Exit(t *testing.T) {
+	decoded := runTestScript(t, "#!/bin/sh\necho '{}'\necho oops >&2\nexit 3\n")
+	if decoded["error"] != "EINVAL" || decoded["reason"] != "exit" ||
+		decoded["exit_status"] != 3.0 || decoded["stderr_tail"] != "oops\n" {
+		t.Errorf("unexpected report %v", decoded)
+	}
+}
+
+func TestFailure_Signal(t *testing.T) {
+	decoded := runTestScript(t, "#!/bin/sh\nkill -9 $$\n")
+	if decoded["reason"] != "signal" || decoded["signal"] != "killed" {
+		t.Errorf("unexpected report %v", decoded)
+	}
+}
+
+func TestFailure_Decode(t *testing.T) {
+	decoded := runTestScript(t, "#!/bin/sh\necho '{\"a\":1,}'\n")
+	if decoded["error"] != "EINVAL" || decoded["reason"] != "decode" ||
+		decoded["decode_offset"] != 8.0 ||
+		decoded["stdout_excerpt"] != "{\"a\":1,}\n" {
+		t.Errorf("unexpected report %v", decoded)
+	}
+}
+
+func TestFailure_Exec(t *testing.T) {
+	decoded := runTestScript(t, "")
+	if decoded["error"] != "ENOENT" || decoded["reason"] != "exec" {
+		t.Errorf("unexpected report %v", decoded)
+	}
+}
+
+func TestFailure_Valid(t *testing.T) {
+	decoded := runTestScript(t, "#!/bin/sh\necho '{\"a\":1}'\n")
+	if decoded["a"] != 1.0 || decoded["error"] != nil {
+		t.Errorf("unexpected data %v", decoded)
+	}
+}
+
+func TestRunShellCollector_Cancelled(t *testing.T) {
+	discardLog(t)
+	dir, err := ioutil.TempDir("", "gocollect-failure-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	execpath := filepath.Join(dir, "test.collector")
+	ioutil.WriteFile(execpath, []byte("#!/bin/sh\nsleep 30\n"), 0755)
+
+	// Shutting down is not a collector failure: there is nothing to
+	// push (or print), only the report says it was aborted.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	report := &data.RunReport{}
+	collected := runShellCollector(data.NewReportContext(ctx, report),
+		"test.collector", execpath, data.Settings{})
+	if collected != nil {
+		t.Errorf("expected nothing, got %s", collected.String())
+	}
+	if report.Failure != "aborted" {
+		t.Errorf("expected aborted, got %q", report.Failure)
+	}
+}
@@ -3,10 +3,13 @@
 package shcollectors
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 
 	"github.com/ossobv/gocollect/gocollect-client/data"
 	"github.com/ossobv/gocollect/gocollect-client/log"
@@ -15,28 +18,28 @@ import (
 // Find returns a object that holds all runnable collector scripts found
 // in the supplied paths.
 //
-// The paths are scanned in reverse order. The file name is the unique
-// key name. If the file is not executable, the collector is disabled.
+// The file name is the unique key name. A script in a later path
+// overrides the one in an earlier path; those end up in Shadowed. If
+// the file is not executable, the collector is disabled.
 func Find(paths []string) *data.Collectors {
 	ret := data.Collectors{}
 
-	last := len(paths) - 1
-	for i := range paths {
-		readpath := paths[last-i]
-
+	for _, readpath := range paths {
 		filelist, e := ioutil.ReadDir(readpath)
-		if e == nil {
-			for _, fileinfo := range filelist {
-				name := fileinfo.Name()
-				// Since we scan the items in reverse order, we only add
-				// the file if it didn't exist yet.
-				if _, exists := ret[name]; !exists {
-					collector := fileToCollector(fileinfo, readpath)
-					if collector != nil {
-						ret[name] = *collector
-					}
-				}
+		if e != nil {
+			continue
+		}
+		for _, fileinfo := range filelist {
+			collector := fileToCollector(fileinfo, readpath)
+			if collector == nil {
+				continue
+			}
+			name := fileinfo.Name()
+			if previous, exists := ret[name]; exists {
+				collector.Shadowed = append(
+					previous.Shadowed, previous.RunArgs)
 			}
+			ret[name] = *collector
 		}
 	}
 	return &ret
@@ -49,7 +52,7 @@ func fileToCollector(fileinfo os.FileInfo, readpath string) *data.Collector {
 	}
 
 	// Create a new collector.
-	return &data.Collector{
+	collector := &data.Collector{
 		// Our runner
 		Run: runShellCollector,
 		// Set full path
@@ -57,11 +60,20 @@ func fileToCollector(fileinfo os.FileInfo, readpath string) *data.Collector {
 		// If the file is not executable, disable it
 		IsEnabled: isExecutable(fileinfo),
 	}
+	if !collector.IsEnabled {
+		collector.Reason = "not executable"
+	}
+	return collector
 }
 
 // runShellCollector runs the collector named key, with specified
 // execpath and returns a Data object.
-func runShellCollector(key string, execpath string) data.Collected {
+func runShellCollector(
+	ctx context.Context, key string, execpath string,
+	settings data.Settings) data.Collected {
+
+	logger := log.FromContext(ctx)
+
 	// Create a clean environment without LC_ALL to mess up output.
 	// But make sure there is a valid path so we can find useful
 	// binaries like ip(1).
@@ -74,24 +86,24 @@ func runShellCollector(key string, execpath string) data.Collected {
 	}
 	cleanEnv := []string{pathEnv}
 
-	// Check if there is a timeout binary before defaulting to using it.
-	cmd := exec.Command("timeout", "1s", "/bin/true")
-	cmd.Env = cleanEnv
-	stdout, e := cmd.Output()
+	// Add the environment from the config.
+	cleanEnv = append(cleanEnv, settings.Env...)
 
-	if e == nil {
-		// TODO: point stderr to somewhere?
-		cmd = exec.Command("timeout", "180s", execpath)
-		cmd.Env = cleanEnv
-		stdout, e = cmd.Output()
-	} else {
-		// Go without timeout.
-		log.Log.Printf(
-			"collector[%s]: no timeout binary found to use", key)
-		cmd = exec.Command(execpath)
-		cmd.Env = cleanEnv
-		stdout, e = cmd.Output()
-	}
+	// Run the collector, killing it if it takes too long. Stderr is
+	// logged and stored in the run report.
+	var stdoutBuf bytes.Buffer
+	report := data.ReportFromContext(ctx)
+	stderr := newStderrWriter(
+		key, logger, report, settings.StderrLimit)
+	cmd := exec.Command(execpath, settings.Args...)
+	cmd.Env = cleanEnv
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = stderr
+	startTime := time.Now()
+	e := runCommand(ctx, cmd)
+	duration := time.Since(startTime)
+	stdout := stdoutBuf.Bytes()
+	stderr.Close()
 
 	// If the process returned non-zero, then err is non-nil. However,
 	// if we're using filters in the command, then we will probably get
@@ -104,18 +116,34 @@ func runShellCollector(key string, execpath string) data.Collected {
 		}
 
 		// I guess not.
-		log.Log.Printf(
+		logger.Printf(
 			"collector[%s]: decode error: %s", key, e.Error())
-		log.Log.Printf("collector[%s]: data: %s", key, stdout)
+		logger.Printf("collector[%s]: data: %s", key, stdout)
+	} else if e == errTimedOut {
+		logger.Printf(
+			"collector[%s]: %s killed after %s", key, execpath,
+			duration.Round(time.Millisecond))
+	} else if e == context.Canceled {
+		// We're shutting down. There is nothing to report: the
+		// collector did nothing wrong.
+		logger.Printf(
+			"collector[%s]: %s killed; aborted", key, execpath)
+		if report != nil {
+			report.Failure = "aborted"
+		}
+		return nil
 	} else {
 		// Probably '!cmd.ProcessState.Success()'.
-		log.Log.Printf(
+		logger.Printf(
 			"collector[%s]: %s error: %s", key, execpath, e.Error())
 	}
 
-	// Tell the server that something is wrong here.
-	ret, _ := data.NewCollected([]byte("{\"error\":\"EINVAL\"}\n"))
-	return ret
+	// Tell the server what is wrong here.
+	f := newFailure(execpath, duration, e, stdout, stderr.tail.Bytes())
+	if report != nil {
+		report.Failure = f.Reason
+	}
+	return f.collected()
 }
 
 func isExecutable(fileinfo os.FileInfo) bool {
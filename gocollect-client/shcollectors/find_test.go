@@ -3,6 +3,7 @@
 package shcollectors
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -17,7 +18,7 @@ func ExampleFind() {
 
 	// We can run a single collector using those keys. For instance the
 	// core.id key.
-	data := collectors.Run("core.id")
+	data := collectors.Run(context.Background(), "core.id")
 	ip4 := data.GetString("ip4")
 	if ip4 == "" {
 		fmt.Println("ip4 empty?")
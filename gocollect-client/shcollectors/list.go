@@ -0,0 +1,112 @@
+// Package shcollectors (gocollect) makes shell-script plugins available
+// for collection.
+package shcollectors
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Script describes a collector script, as found by Find.
+type Script struct {
+	// Path is the script that is used.
+	Path string `json:"path"`
+	// Shadowed holds the scripts with the same name in earlier
+	// collectors paths, which are not used.
+	Shadowed []string `json:"shadowed,omitempty"`
+	// Requires holds the "# REQUIRES:" header lines of the script.
+	Requires []Requirement `json:"requires,omitempty"`
+}
+
+// Requirement is a single requirement of a script: one or more
+// alternative packages.
+type Requirement []Package
+
+// Package is a (Debian) package, with an optional version constraint
+// in the name, and the commands the script uses from it. The header
+// "coreutils(cut tr)" means: the cut and tr commands from coreutils.
+type Package struct {
+	Name     string   `json:"name"`
+	Commands []string `json:"commands,omitempty"`
+}
+
+// String returns the requirement in header syntax.
+func (req Requirement) String() string {
+	alternatives := make([]string, len(req))
+	for i, pkg := range req {
+		alternatives[i] = pkg.Name
+		if len(pkg.Commands) != 0 {
+			alternatives[i] += "(" + strings.Join(pkg.Commands, " ") + ")"
+		}
+	}
+	return strings.Join(alternatives, " | ")
+}
+
+// Scan returns the collector scripts in the supplied paths, like Find,
+// but with details about where they came from.
+func Scan(paths []string) map[string]*Script {
+	ret := make(map[string]*Script)
+	for name, collector := range *Find(paths) {
+		script := &Script{
+			Path: collector.RunArgs, Shadowed: collector.Shadowed}
+		if file, e := os.Open(script.Path); e == nil {
+			script.Requires = ParseRequires(file)
+			file.Close()
+		}
+		ret[name] = script
+	}
+	return ret
+}
+
+var (
+	requiresPrefix = "# REQUIRES:"
+	requiresToken  = regexp.MustCompile(`[^\s|()]+(\([^)]*\))?|\|`)
+)
+
+// ParseRequires parses the "# REQUIRES:" lines in the header (the
+// leading comment block) of a script. A line holds one or more
+// requirements, like "coreutils(cut) iproute2(ip) | iproute(ip)".
+// Anything after a second # is a comment.
+func ParseRequires(r io.Reader) (ret []Requirement) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			break // end of the header
+		}
+		if !strings.HasPrefix(line, requiresPrefix) {
+			continue
+		}
+		line = line[len(requiresPrefix):]
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		var req Requirement
+		alternative := false
+		for _, token := range requiresToken.FindAllString(line, -1) {
+			if token == "|" {
+				alternative = true
+				continue
+			}
+			pkg := Package{Name: token}
+			if i := strings.IndexByte(token, '('); i >= 0 {
+				pkg.Name = token[:i]
+				pkg.Commands = strings.Fields(token[i+1 : len(token)-1])
+			}
+			if !alternative && len(req) != 0 {
+				ret = append(ret, req)
+				req = nil
+			}
+			req = append(req, pkg)
+			alternative = false
+		}
+		if len(req) != 0 {
+			ret = append(ret, req)
+		}
+	}
+	return ret
+}
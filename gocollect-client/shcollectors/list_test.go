@@ -0,0 +1,88 @@
+package shcollectors
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRequires(t *testing.T) {
+	header := ("#!/bin/sh\n" +
+		"# LABELS: optional\n" +
+		"# REQUIRES: coreutils(cut tr)\n" +
+		"# REQUIRES: iproute2(ip) | iproute(ip)\n" +
+		"# REQUIRES: jq(jq) base-files>=7.2(os-release) kubectl\n" +
+		"# REQUIRES: util-linux(lscpu)  # optional\n" +
+		"\n" +
+		"echo '{}'\n" +
+		"# REQUIRES: not-in-header\n")
+
+	var got []string
+	for _, req := range ParseRequires(strings.NewReader(header)) {
+		got = append(got, req.String())
+	}
+	expected := []string{
+		"coreutils(cut tr)",
+		"iproute2(ip) | iproute(ip)",
+		"jq(jq)",
+		"base-files>=7.2(os-release)",
+		"kubectl",
+		"util-linux(lscpu)",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s",
+			strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocollect-scan-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var paths []string
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, name)
+		os.Mkdir(path, 0755)
+		paths = append(paths, path)
+	}
+	script := "#!/bin/sh\n# REQUIRES: jq(jq)\necho '{}'\n"
+	ioutil.WriteFile(filepath.Join(paths[0], "app.x"), []byte(script), 0755)
+	ioutil.WriteFile(filepath.Join(paths[1], "app.x"), []byte(script), 0644)
+	ioutil.WriteFile(filepath.Join(paths[2], "app.x"), []byte(script), 0755)
+	ioutil.WriteFile(filepath.Join(paths[0], "app.y"), []byte(script), 0755)
+	// A directory does not override a script.
+	os.Mkdir(filepath.Join(paths[2], "app.y"), 0755)
+
+	scripts := Scan(paths)
+	if len(scripts) != 2 {
+		t.Fatalf("expected 2 scripts, got %d", len(scripts))
+	}
+	x := scripts["app.x"]
+	assertStrings(t, "app.x path",
+		[]string{x.Path}, []string{filepath.Join(paths[2], "app.x")})
+	assertStrings(t, "app.x shadowed", x.Shadowed, []string{
+		filepath.Join(paths[0], "app.x"), filepath.Join(paths[1], "app.x")})
+	y := scripts["app.y"]
+	assertStrings(t, "app.y path",
+		[]string{y.Path}, []string{filepath.Join(paths[0], "app.y")})
+	assertStrings(t, "app.y shadowed", y.Shadowed, nil)
+	if len(y.Requires) != 1 || y.Requires[0].String() != "jq(jq)" {
+		t.Errorf("app.y requires: got %v", y.Requires)
+	}
+
+	// Find agrees on which script is used.
+	collectors := *Find(paths)
+	if collectors["app.x"].RunArgs != x.Path {
+		t.Errorf("Find app.x: got %s", collectors["app.x"].RunArgs)
+	}
+}
+
+func assertStrings(t *testing.T, what string, got, expected []string) {
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("%s: got %q, expected %q", what, got, expected)
+	}
+}
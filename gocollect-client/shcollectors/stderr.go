@@ -0,0 +1,129 @@
+// Package shcollectors (gocollect) makes shell-script plugins available
+// for collection.
+package shcollectors
+
+import (
+	"bytes"
+	golog "log"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
+// DefaultStderrLogLimit logs the first 10 stderr lines of a collector
+// run, and then at most one line per second.
+var DefaultStderrLogLimit = data.LogLimit{Burst: 10, Interval: time.Second}
+
+// Limits for the stderr lines stored in the run report.
+const (
+	maxReportedStderrLines = 100
+	maxStderrLineLength    = 512
+)
+
+// stderrWriter is the io.Writer for the stderr of a collector. It logs
+// the lines, prefixed with the collector key, and stores them in the
+// run report. It also keeps the tail for the failure report.
+type stderrWriter struct {
+	key     string
+	logger  *golog.Logger
+	report  *data.RunReport
+	tail    tailBuffer
+	partial []byte
+
+	// Rate limiting: the lines we may log right away, when we last
+	// added to those, and the lines we did not log.
+	limit      data.LogLimit
+	tokens     int
+	refilled   time.Time
+	suppressed int
+	now        func() time.Time
+}
+
+func newStderrWriter(
+	key string, logger *golog.Logger, report *data.RunReport,
+	limit data.LogLimit) *stderrWriter {
+
+	return &stderrWriter{
+		key: key, logger: logger, report: report,
+		tail:  tailBuffer{max: maxStderrTail},
+		limit: limit, tokens: limit.Burst, now: time.Now}
+}
+
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	w.tail.Write(p)
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i == -1 {
+			break
+		}
+		w.addLine(w.partial[0:i])
+		w.partial = w.partial[i+1:]
+	}
+	// Don't let a single endless line eat our memory.
+	if len(w.partial) > maxStderrLineLength {
+		w.addLine(w.partial)
+		w.partial = nil
+	}
+	return len(p), nil
+}
+
+// Close flushes the last unterminated line and logs how many lines
+// were not logged.
+func (w *stderrWriter) Close() error {
+	if len(w.partial) > 0 {
+		w.addLine(w.partial)
+		w.partial = nil
+	}
+	w.logSuppressed()
+	return nil
+}
+
+func (w *stderrWriter) addLine(line []byte) {
+	if len(line) > maxStderrLineLength {
+		line = line[0:maxStderrLineLength]
+	}
+	if w.allow() {
+		w.logSuppressed()
+		w.logger.Printf("collector[%s]: stderr: %s", w.key, line)
+	} else {
+		w.suppressed++
+	}
+	if w.report != nil && len(w.report.Stderr) < maxReportedStderrLines {
+		w.report.Stderr = append(w.report.Stderr, string(line))
+	}
+}
+
+// allow returns true if we may log another line: we have a token left,
+// after adding one for every Interval since the last refill.
+func (w *stderrWriter) allow() bool {
+	if w.limit.Burst <= 0 {
+		return true
+	}
+	now := w.now()
+	if w.refilled.IsZero() {
+		w.refilled = now
+	} else if w.limit.Interval > 0 {
+		n := now.Sub(w.refilled) / w.limit.Interval
+		if n > 0 {
+			w.tokens += int(n)
+			if w.tokens > w.limit.Burst {
+				w.tokens = w.limit.Burst
+			}
+			w.refilled = w.refilled.Add(n * w.limit.Interval)
+		}
+	}
+	if w.tokens == 0 {
+		return false
+	}
+	w.tokens--
+	return true
+}
+
+func (w *stderrWriter) logSuppressed() {
+	if w.suppressed > 0 {
+		w.logger.Printf("collector[%s]: stderr: (%d lines not logged)",
+			w.key, w.suppressed)
+		w.suppressed = 0
+	}
+}
@@ -0,0 +1,101 @@
+package shcollectors
+
+import (
+	"bytes"
+	golog "log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ossobv/gocollect/gocollect-client/data"
+)
+
+// newTestStderrWriter returns a stderrWriter that logs to the returned
+// buffer and takes the time from *now.
+func newTestStderrWriter(limit data.LogLimit, now *time.Time) (
+	*stderrWriter, *bytes.Buffer, *data.RunReport) {
+
+	buf := &bytes.Buffer{}
+	report := &data.RunReport{}
+	w := newStderrWriter("app.test", golog.New(buf, "", 0), report, limit)
+	w.now = func() time.Time { return *now }
+	return w, buf, report
+}
+
+func TestStderrWriter_Lines(t *testing.T) {
+	now := time.Now()
+	w, buf, report := newTestStderrWriter(data.LogLimit{}, &now)
+
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\n\nthr"))
+	w.Write([]byte("ee"))
+	if got := buf.String(); got != ("collector[app.test]: stderr: one\n" +
+		"collector[app.test]: stderr: two\n" +
+		"collector[app.test]: stderr: \n") {
+		t.Errorf("unexpected log before Close: %q", got)
+	}
+	w.Close()
+	if !strings.HasSuffix(buf.String(), "stderr: three\n") {
+		t.Errorf("expected partial line on Close, got %q", buf.String())
+	}
+	expected := []string{"one", "two", "", "three"}
+	if strings.Join(report.Stderr, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected report %q, got %q", expected, report.Stderr)
+	}
+	if got := string(w.tail.Bytes()); got != "one\ntwo\n\nthree" {
+		t.Errorf("unexpected tail %q", got)
+	}
+}
+
+func TestStderrWriter_LongLine(t *testing.T) {
+	now := time.Now()
+	w, _, report := newTestStderrWriter(data.LogLimit{}, &now)
+
+	long := strings.Repeat("x", maxStderrLineLength+100)
+	w.Write([]byte(long + "\n"))
+	// An unterminated line is flushed once it gets too long.
+	w.Write([]byte(long))
+	if len(report.Stderr) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(report.Stderr))
+	}
+	for _, line := range report.Stderr {
+		if len(line) != maxStderrLineLength {
+			t.Errorf("expected truncated line, got %d bytes", len(line))
+		}
+	}
+	w.Close()
+	if len(report.Stderr) != 2 {
+		t.Errorf("expected nothing left on Close, got %d lines",
+			len(report.Stderr))
+	}
+}
+
+func TestStderrWriter_RateLimit(t *testing.T) {
+	now := time.Now()
+	w, buf, report := newTestStderrWriter(
+		data.LogLimit{Burst: 2, Interval: time.Second}, &now)
+
+	w.Write([]byte("1\n2\n3\n4\n"))
+	now = now.Add(1500 * time.Millisecond)
+	w.Write([]byte("5\n6\n"))
+	now = now.Add(time.Minute)
+	w.Write([]byte("7\n8\n9\n"))
+	w.Close()
+
+	expected := "" +
+		"collector[app.test]: stderr: 1\n" +
+		"collector[app.test]: stderr: 2\n" +
+		"collector[app.test]: stderr: (2 lines not logged)\n" +
+		"collector[app.test]: stderr: 5\n" +
+		"collector[app.test]: stderr: (1 lines not logged)\n" +
+		"collector[app.test]: stderr: 7\n" +
+		"collector[app.test]: stderr: 8\n" +
+		"collector[app.test]: stderr: (1 lines not logged)\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("expected log:\n%s\ngot:\n%s", expected, got)
+	}
+	// The report gets everything.
+	if len(report.Stderr) != 9 {
+		t.Errorf("expected 9 reported lines, got %d", len(report.Stderr))
+	}
+}
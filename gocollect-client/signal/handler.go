@@ -36,3 +36,12 @@ func NewAlarmHupUsr1() Handler {
 	signal.Notify(signalChan, syscall.SIGUSR1)
 	return Handler{Chan: signalChan}
 }
+
+// NewTermInt initializes signal handlers for TERM and INT. Read the
+// Handler.Chan and shut down gracefully.
+func NewTermInt() Handler {
+	signalChan := make(chan os.Signal, 2)
+	signal.Notify(signalChan, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT)
+	return Handler{Chan: signalChan}
+}